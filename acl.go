@@ -0,0 +1,186 @@
+package zkregistry
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// ACLs are the zookeeper ACLs of the nodes created by the registry, by level.
+// A nil level defaults to zk.WorldACL(zk.PermAll).
+// With layouts of other depth, the Service ACL applies to the first level below the root,
+// the Version one to the other parents and the Endpoint one to the instance nodes.
+//
+// i.e. world readable, only writable by the credentials given with WithAuth:
+//
+//	acl := append(zk.WorldACL(zk.PermRead), zk.AuthACL(zk.PermAll)...)
+//	ACLs{Root: acl, Service: acl, Version: acl, Endpoint: acl}
+//
+// NOTE: registering an endpoint requires the create permission on its parent node.
+type ACLs struct {
+	Root     []zk.ACL // The registry path, including its missing parents.
+	Service  []zk.ACL
+	Version  []zk.ACL
+	Endpoint []zk.ACL
+}
+
+// ACLCheck is the startup verification of the ACLs of the existing nodes, see WithACLCheck.
+type ACLCheck int
+
+// ACL verification modes.
+const (
+	ACLCheckNone ACLCheck = iota // Do not verify.
+	ACLCheckWarn                 // Log the mismatches.
+	ACLCheckFail                 // Fail New on mismatch.
+)
+
+// defaultACL is used for the levels without ACL.
+var defaultACL = zk.WorldACL(zk.PermAll)
+
+// orDefault returns the given acl, or the default one if empty.
+func orDefault(acl []zk.ACL) []zk.ACL {
+	if len(acl) == 0 {
+		return defaultACL
+	}
+	return acl
+}
+
+// level returns the ACL of the nodes at the given depth below the root, see layout:
+// the Root ACL for the root, the Endpoint one for the instance nodes, the Service one
+// for the first level of parents and the Version one for the others.
+func (acls ACLs) level(depth int, l Layout) []zk.ACL {
+	switch {
+	case depth == 0:
+		return orDefault(acls.Root)
+	case depth >= l.Depth():
+		return orDefault(acls.Endpoint)
+	case depth == 1:
+		return orDefault(acls.Service)
+	default:
+		return orDefault(acls.Version)
+	}
+}
+
+// createParents creates the registry root and the given parent nodes if missing,
+// each with the ACL of its level.
+func (reg *ZKRegistry) createParents(elems []string) error {
+	if err := createTree(reg.conn, reg.root, reg.acls.level(0, reg.layout)); err != nil {
+		return err
+	}
+	for i := range elems {
+		if err := createTree(reg.conn, reg.nodePath(elems[:i+1]), reg.acls.level(i+1, reg.layout)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// aclMismatchError reports the registry nodes not carrying the expected ACLs, see verifyACLs.
+type aclMismatchError []string
+
+func (e aclMismatchError) Error() string {
+	return "unexpected ACLs: " + strings.Join(e, "; ")
+}
+
+// verifyACLs compares the ACLs of the existing registry nodes with the configured ones.
+// Depending on the check mode, the mismatches are logged or returned as an error.
+func (reg *ZKRegistry) verifyACLs() error {
+	if reg.aclCheck == ACLCheckNone {
+		return nil
+	}
+	mismatches, err := reg.aclMismatches()
+	if err != nil {
+		return err
+	}
+	if len(mismatches) == 0 {
+		return nil
+	}
+	if reg.aclCheck == ACLCheckFail {
+		return aclMismatchError(mismatches)
+	}
+	for _, mismatch := range mismatches {
+		reg.logger.Printf("Unexpected ACL: %s", mismatch)
+	}
+	return nil
+}
+
+// aclMismatches lists the registry nodes not carrying the ACL of their level.
+func (reg *ZKRegistry) aclMismatches() ([]string, error) {
+	nodes, err := walkTree(reg.conn, reg.root, reg.layout.Depth())
+	if err != nil {
+		return nil, err
+	}
+
+	var mismatches []string
+	for _, elems := range append([][]string{{}}, nodes...) {
+		zkPath := reg.nodePath(elems)
+		acl, _, err := reg.conn.GetACL(zkPath)
+		if err == zk.ErrNoNode {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("error getting the ACL of %q: %s", zkPath, err)
+		}
+		if expect := reg.acls.level(len(elems), reg.layout); !aclMatch(expect, acl) {
+			mismatches = append(mismatches, fmt.Sprintf("%s has %s, expected %s", zkPath, formatACL(acl), formatACL(expect)))
+		}
+	}
+	return mismatches, nil
+}
+
+// aclMatch checks if the ACL stored by zookeeper is the expected one, regardless of the order.
+// Zookeeper replaces the "auth" scheme with the identities of the creator,
+// so it matches any authenticated identity with the same permissions.
+func aclMatch(expect, got []zk.ACL) bool {
+	matched := make([]bool, len(got))
+	for _, e := range expect {
+		found := false
+		for i, g := range got {
+			if e.Perms != g.Perms {
+				continue
+			}
+			if (e.Scheme == "auth" && g.Scheme != "world" && g.Scheme != "ip") || (e.Scheme == g.Scheme && e.ID == g.ID) {
+				matched[i] = true
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, ok := range matched {
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// formatACL returns a readable form of the given ACL, i.e. [world:anyone:r digest:user:xxx:cdrwa].
+func formatACL(acl []zk.ACL) string {
+	parts := make([]string, 0, len(acl))
+	for _, a := range acl {
+		parts = append(parts, fmt.Sprintf("%s:%s:%s", a.Scheme, a.ID, formatPerms(a.Perms)))
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
+
+// formatPerms returns the permissions in the zkCli notation.
+func formatPerms(perms int32) string {
+	ret := ""
+	for _, p := range []struct {
+		perm int32
+		flag string
+	}{
+		{zk.PermCreate, "c"},
+		{zk.PermDelete, "d"},
+		{zk.PermRead, "r"},
+		{zk.PermWrite, "w"},
+		{zk.PermAdmin, "a"},
+	} {
+		if perms&p.perm != 0 {
+			ret += p.flag
+		}
+	}
+	return ret
+}
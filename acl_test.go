@@ -0,0 +1,202 @@
+package zkregistry
+
+import (
+	"bytes"
+	"log"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+func TestACLMatch(t *testing.T) {
+	worldRead := zk.WorldACL(zk.PermRead)
+	digest := zk.DigestACL(zk.PermAll, "user", "password")
+	for _, tc := range []struct {
+		expect, got []zk.ACL
+		match       bool
+	}{
+		{expect: defaultACL, got: zk.WorldACL(zk.PermAll), match: true},
+		{expect: defaultACL, got: worldRead, match: false},
+		{expect: append(worldRead, digest...), got: append(digest, worldRead...), match: true},
+		{expect: worldRead, got: append(worldRead, digest...), match: false},
+		{expect: append(worldRead, digest...), got: worldRead, match: false},
+		{expect: append(worldRead, zk.AuthACL(zk.PermAll)...), got: append(worldRead, digest...), match: true},
+		{expect: zk.AuthACL(zk.PermAll), got: zk.WorldACL(zk.PermAll), match: false},
+	} {
+		if got := aclMatch(tc.expect, tc.got); got != tc.match {
+			t.Errorf("Unexpected match of %s against %s.\nExpect:\t%t\nGot:\t%t", formatACL(tc.got), formatACL(tc.expect), tc.match, got)
+		}
+	}
+
+	if expect, got := "[world:anyone:r ip:10.0.0.0/8:cdrwa]", formatACL(append(worldRead, zk.ACL{Perms: zk.PermAll, Scheme: "ip", ID: "10.0.0.0/8"})); expect != got {
+		t.Fatalf("Unexpected format.\nExpect:\t%s\nGot:\t%s", expect, got)
+	}
+}
+
+// authConnect connects to zookeeper with the test digest credentials.
+func authConnect(t *testing.T) *zk.Conn {
+	conn, _, err := zk.Connect([]string{testZKHost}, 1*time.Second)
+	if err != nil {
+		t.Fatalf("Unable to connect to ZK: %s", err)
+	}
+	conn.SetLogger(discardLogger)
+	if err := conn.AddAuth("digest", []byte("user:password")); err != nil {
+		conn.Close()
+		t.Fatalf("Error adding credentials: %s", err)
+	}
+	return conn
+}
+
+// worldReadCreatorAll is readable by anyone and writable only by the creator.
+var worldReadCreatorAll = append(zk.WorldACL(zk.PermRead), zk.AuthACL(zk.PermAll)...)
+
+func TestACLs(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	authConn := authConnect(t)
+	defer authConn.Close()
+	defer func() { _ = removeTree(authConn, path.Join(conn.prefix, "/test")) }() // Best effort.
+
+	root := path.Join(conn.prefix, "/test/discovery")
+	acls := ACLs{Root: worldReadCreatorAll, Service: worldReadCreatorAll, Version: worldReadCreatorAll, Endpoint: zk.WorldACL(zk.PermRead)}
+	reg, err := New(authConn, root, discardLogger, WithACLs(acls), WithACLCheck(ACLCheckFail))
+	if err != nil {
+		t.Fatalf("Error creating the registry: %s", err)
+	}
+	defer func() { _ = reg.Close() }() // Best effort.
+
+	if _, err := reg.Register("name", "version", "addr"); err != nil {
+		t.Fatalf("Error registering endpoint: %s", err)
+	}
+	for zkPath, expect := range map[string][]zk.ACL{
+		root:                               acls.Root,
+		path.Join(root, "name"):            acls.Service,
+		path.Join(root, "name", "version"): acls.Version,
+		path.Join(root, "name", "version", "addr"): acls.Endpoint,
+	} {
+		got, _, err := conn.conn.GetACL(zkPath)
+		if err != nil {
+			t.Fatalf("Error getting the ACL of %q: %s", zkPath, err)
+		}
+		if !aclMatch(expect, got) {
+			t.Errorf("Unexpected ACL on %q.\nExpect:\t%s\nGot:\t%s", zkPath, formatACL(expect), formatACL(got))
+		}
+	}
+
+	// Anyone can read, only the creator can register.
+	if _, _, err := conn.conn.Children(path.Join(root, "name", "version")); err != nil {
+		t.Fatalf("Error listing the endpoints: %s", err)
+	}
+	if _, err := conn.conn.Create(path.Join(root, "name", "version", "other"), nil, zk.FlagEphemeral, zk.WorldACL(zk.PermAll)); err != zk.ErrNoAuth {
+		t.Fatalf("Unexpected error.\nExpect:\t%v\nGot:\t%v", zk.ErrNoAuth, err)
+	}
+	if err := conn.conn.Delete(path.Join(root, "name"), -1); err != zk.ErrNoAuth {
+		t.Fatalf("Unexpected error.\nExpect:\t%v\nGot:\t%v", zk.ErrNoAuth, err)
+	}
+
+	// A restarted registry finds the expected ACLs.
+	reg2, err := New(authConn, root, discardLogger, WithACLs(acls), WithACLCheck(ACLCheckFail))
+	if err != nil {
+		t.Fatalf("Error creating the registry: %s", err)
+	}
+	_ = reg2.Close() // Best effort.
+}
+
+func TestACLCheck(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	authConn := authConnect(t)
+	defer authConn.Close()
+
+	// Created with the default world ACL.
+	assertCreateTree(t, conn, "/test/discovery/name/version")
+	root := path.Join(conn.prefix, "/test/discovery")
+	acls := ACLs{Root: worldReadCreatorAll, Service: worldReadCreatorAll, Version: worldReadCreatorAll}
+
+	if reg, err := New(authConn, root, discardLogger, WithACLs(acls)); err != nil {
+		t.Fatalf("Error creating the registry without verification: %s", err)
+	} else {
+		_ = reg.Close() // Best effort.
+	}
+
+	_, err := New(authConn, root, discardLogger, WithACLs(acls), WithACLCheck(ACLCheckFail))
+	if err == nil {
+		t.Fatal("ACL mismatch should fail the registry creation")
+	}
+	for _, zkPath := range []string{root, path.Join(root, "name"), path.Join(root, "name", "version")} {
+		if !strings.Contains(err.Error(), zkPath+" has [world:anyone:cdrwa]") {
+			t.Errorf("The error should report %q: %s", zkPath, err)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	reg, err := New(authConn, root, log.New(buf, "", 0), WithACLs(acls), WithACLCheck(ACLCheckWarn))
+	if err != nil {
+		t.Fatalf("Error creating the registry with ACL warnings: %s", err)
+	}
+	_ = reg.Close() // Best effort.
+	if expect, got := 3, strings.Count(buf.String(), "Unexpected ACL: "); expect != got {
+		t.Fatalf("Unexpected number of warnings.\nExpect:\t%d\nGot:\t%d\n%s", expect, got, buf.String())
+	}
+
+	// The default ACL matches.
+	if reg, err := New(authConn, root, discardLogger, WithACLCheck(ACLCheckFail)); err != nil {
+		t.Fatalf("Error creating the registry with default ACLs: %s", err)
+	} else {
+		_ = reg.Close() // Best effort.
+	}
+}
+
+// Make sure the ACLs get verified once connected after a degraded start.
+func TestACLCheckDegraded(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	file, cleanup := tempSnapshotFile(t)
+	defer cleanup()
+	data, err := encodeSnapshotFile(newCatalog().withVersion("name", "version", newEndpointList([]Instance{{Address: "addr"}})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(file, data); err != nil {
+		t.Fatal(err)
+	}
+
+	// Created with the default world ACL.
+	assertCreateTree(t, conn, "/test/discovery/name/version")
+	root := path.Join(conn.prefix, "/test/discovery")
+	acls := ACLs{Root: worldReadCreatorAll, Service: worldReadCreatorAll, Version: worldReadCreatorAll}
+
+	// Zookeeper unreachable at startup.
+	p := newTCPProxy(t, testZKHost)
+	p.Start()
+	p.Stop()
+	proxyConn, _, err := zk.Connect([]string{p.URL}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyConn.Close()
+
+	buf := &bytes.Buffer{}
+	reg, err := New(proxyConn, root, log.New(buf, "", 0), WithACLs(acls), WithACLCheck(ACLCheckFail), WithSnapshotFile(file))
+	if err != nil {
+		t.Fatalf("The registry should start from the snapshot: %s", err)
+	}
+
+	// Once reachable, the mismatch keeps the registry on the snapshot.
+	p.Start()
+	defer p.Stop()
+	time.Sleep(3 * time.Second)
+	if h := reg.Health(); h.Ready() || !h.Stale {
+		t.Fatalf("The registry should still be stale: %+v", h)
+	}
+	_ = reg.Close() // Best effort.
+	if !strings.Contains(buf.String(), "unexpected ACLs: "+root+" has [world:anyone:cdrwa]") {
+		t.Fatalf("The ACL mismatch should be reported:\n%s", buf.String())
+	}
+}
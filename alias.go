@@ -0,0 +1,108 @@
+package zkregistry
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// setAliases sets the aliases of the given service and notifies the subscribers of the changed ones.
+// Nil aliases remove them all.
+func (reg *ZKRegistry) setAliases(name string, aliases map[string]string) {
+	if len(aliases) == 0 {
+		aliases = nil
+	}
+
+	reg.lock.Lock()
+	current := reg.catalog()
+	previous := current.aliases[name]
+	if reflect.DeepEqual(previous, aliases) {
+		reg.lock.Unlock()
+		return
+	}
+	reg.commitLocked(current.withAliases(name, aliases))
+	reg.lock.Unlock()
+
+	changed := map[string]struct{}{}
+	for alias, target := range previous {
+		if aliases[alias] != target {
+			changed[alias] = struct{}{}
+		}
+	}
+	for alias, target := range aliases {
+		if previous[alias] != target {
+			changed[alias] = struct{}{}
+		}
+	}
+	reg.subLock.Lock()
+	for sub := range reg.subscriptions {
+		for alias := range changed {
+			sub.publishAlias(serviceKey{name: name, version: alias})
+		}
+	}
+	reg.subLock.Unlock()
+}
+
+// Aliases returns the aliases of the given service name, i.e. {"stable": "1.4.2"}.
+func (reg *ZKRegistry) Aliases(name string) map[string]string {
+	aliases := reg.catalog().aliases[name]
+	ret := make(map[string]string, len(aliases))
+	for alias, target := range aliases {
+		ret[alias] = target
+	}
+	return ret
+}
+
+// SetAlias points the given alias of the service to the given version, see SetAliases.
+func (reg *ZKRegistry) SetAlias(name, alias, version string) error {
+	return reg.SetAliases(name, map[string]string{alias: version})
+}
+
+// SetAliases points the given aliases of the service to their version in a single transaction,
+// the other aliases are untouched. An empty version removes the alias.
+// The aliases are stored in the service node and resolved by Lookup for the versions not known as such,
+// i.e. a blue/green cutover, atomic for every client of the service:
+//
+//	reg.SetAliases("billing", map[string]string{"stable": "1.5.0", "previous": "1.4.2"})
+//
+// The target versions must exist, they are checked along with the update.
+func (reg *ZKRegistry) SetAliases(name string, aliases map[string]string) error {
+	if err := validatePathElem("service name", name); err != nil {
+		return err
+	}
+	current := reg.catalog()
+	var checks []interface{}
+	for alias, version := range aliases {
+		if err := validatePathElem("alias", alias); err != nil {
+			return err
+		}
+		if _, ok := current.services[name][alias]; ok {
+			return fmt.Errorf("alias %q shadows a version of %s", alias, name)
+		}
+		if version == "" {
+			continue
+		}
+		if _, ok := current.aliases[name][version]; ok {
+			return fmt.Errorf("alias %q points to the alias %q of %s", alias, version, name)
+		}
+		check, err := reg.versionCheck(name, version)
+		if err != nil {
+			return err
+		}
+		if check != nil {
+			checks = append(checks, check)
+		}
+	}
+
+	return reg.updateServiceNode(name, checks, func(service *serviceData) {
+		if service.aliases == nil {
+			service.aliases = map[string]string{}
+		}
+		for alias, version := range aliases {
+			if version == "" {
+				delete(service.aliases, alias)
+			} else {
+				service.aliases[alias] = version
+			}
+		}
+	})
+}
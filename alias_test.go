@@ -0,0 +1,186 @@
+package zkregistry
+
+import (
+	"path"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// assertEventualAliases waits for the registry to know the given aliases.
+func assertEventualAliases(t *testing.T, reg *ZKRegistry, name string, expect map[string]string) {
+	file, line := getCaller(t, 1)
+	var got map[string]string
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if got = reg.Aliases(name); reflect.DeepEqual(expect, got) {
+			return
+		}
+	}
+	t.Fatalf("[%s:%d] Unexpected aliases.\nExpect:\t%v\nGot:\t%v", file, line, expect, got)
+}
+
+func TestAliases(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	root := path.Join(conn.prefix, "discovery")
+	var registrations []*Registration
+	for version, endpoint := range map[string]string{"1.4.2": "blue", "1.5.0": "green"} {
+		r, err := conn.Register("billing", version, endpoint)
+		if err != nil {
+			t.Fatalf("Error registering endpoint: %s", err)
+		}
+		registrations = append(registrations, r)
+	}
+	assertEventualLookup(t, conn.ZKRegistry, "billing", "1.5.0", []string{"green"}, nil)
+
+	// Other fields of the service node are preserved.
+	if _, err := conn.conn.Set(path.Join(root, "billing"), []byte(`{"owner": "team"}`), -1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.SetAlias("billing", "stable", "1.4.2"); err != nil {
+		t.Fatalf("Error setting alias: %s", err)
+	}
+	assertEventualLookup(t, conn.ZKRegistry, "billing", "stable", []string{"blue"}, nil)
+
+	// Another client of the service follows the cutover.
+	other, err := New(conn.conn, root, discardLogger)
+	if err != nil {
+		t.Fatalf("Error creating the registry: %s", err)
+	}
+	defer func() { _ = other.Close() }() // Best effort.
+	assertEventualLookup(t, other, "billing", "stable", []string{"blue"}, nil)
+
+	sub := other.Subscribe("billing", "stable")
+	defer sub.Close()
+	assertServiceEvent(t, sub, ServiceEvent{
+		Name: "billing", Version: "stable",
+		Endpoints: []string{"blue"},
+		Added:     []string{"blue"},
+	})
+
+	if err := conn.SetAliases("billing", map[string]string{"stable": "1.5.0", "previous": "1.4.2"}); err != nil {
+		t.Fatalf("Error setting aliases: %s", err)
+	}
+	assertServiceEvent(t, sub, ServiceEvent{
+		Name: "billing", Version: "stable",
+		Endpoints: []string{"green"},
+		Added:     []string{"green"},
+		Removed:   []string{"blue"},
+	})
+	assertEventualLookup(t, other, "billing", "previous", []string{"blue"}, nil)
+	assertEventualAliases(t, other, "billing", map[string]string{"stable": "1.5.0", "previous": "1.4.2"})
+
+	data, _, err := conn.conn.Get(path.Join(root, "billing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service, err := parseServiceData(data); err != nil || service.fields["owner"] == nil || string(*service.fields["owner"]) != `"team"` {
+		t.Fatalf("Unexpected service data: %s (%v)", data, err)
+	}
+
+	// The endpoint changes of the target version are delivered to the alias subscribers.
+	r, err := conn.Register("billing", "1.5.0", "green2")
+	if err != nil {
+		t.Fatalf("Error registering endpoint: %s", err)
+	}
+	registrations = append(registrations, r)
+	assertServiceEvent(t, sub, ServiceEvent{
+		Name: "billing", Version: "stable",
+		Endpoints: []string{"green", "green2"},
+		Added:     []string{"green2"},
+	})
+
+	// Invalid aliases are rejected without any change.
+	for _, aliases := range []map[string]string{
+		{"stable": "1.4.2", "canary": "2.0.0"},
+		{"1.4.2": "1.5.0"},
+		{"canary": "stable"},
+		{"a/b": "1.5.0"},
+	} {
+		if err := conn.SetAliases("billing", aliases); err == nil {
+			t.Errorf("%v should fail", aliases)
+		}
+	}
+	if err := conn.SetAlias("unknown", "stable", "1.0.0"); err == nil {
+		t.Error("Aliases of unknown services should fail")
+	}
+	assertEventualAliases(t, conn.ZKRegistry, "billing", map[string]string{"stable": "1.5.0", "previous": "1.4.2"})
+
+	// Removal.
+	if err := conn.SetAlias("billing", "previous", ""); err != nil {
+		t.Fatalf("Error removing alias: %s", err)
+	}
+	assertEventualLookup(t, other, "billing", "previous", nil, ErrServiceNotFound)
+
+	// The aliases go away with the service.
+	for _, r := range registrations {
+		if err := r.Deregister(); err != nil {
+			t.Fatalf("Error deregistering endpoint: %s", err)
+		}
+	}
+	assertRemoveTree(t, conn, "/discovery/billing")
+	assertEventualAliases(t, other, "billing", map[string]string{})
+	assertEventualLookup(t, other, "billing", "stable", nil, ErrServiceNotFound)
+}
+
+// Make sure the reconciliation repairs the aliases.
+func TestReconcileAliases(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	assertCreateTree(t, conn, "/test/discovery/name/v1/addr")
+	root := path.Join(conn.prefix, "/test/discovery")
+	if _, err := conn.conn.Set(path.Join(root, "name"), []byte(`{"aliases": {"stable": "v1"}}`), -1); err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := New(conn.conn, root, discardLogger, WithTickInterval(0))
+	if err != nil {
+		t.Fatalf("Error creating new registry: %s", err)
+	}
+	defer func() { _ = reg.Close() }() // Best effort.
+	assertEventualLookup(t, reg, "name", "stable", []string{"addr"}, nil)
+
+	// Simulate missed events.
+	reg.setAliases("name", map[string]string{"stable": "v0"})
+	reg.setAliases("gone", map[string]string{"stable": "v1"})
+
+	_ = reg.reconcile()
+	if expect, got := map[string]string{"stable": "v1"}, reg.Aliases("name"); !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected aliases.\nExpect:\t%v\nGot:\t%v", expect, got)
+	}
+	if got := reg.Aliases("gone"); len(got) != 0 {
+		t.Fatalf("Stale aliases should be removed: %v", got)
+	}
+	if expect, got := (Stats{Reconciliations: 1, ReconcileRemoved: 1, ReconcileUpdated: 1}), reg.Stats(); expect != got {
+		t.Fatalf("Unexpected stats.\nExpect:\t%+v\nGot:\t%+v", expect, got)
+	}
+}
+
+// Make sure the concurrent changes of the aliases do not get lost.
+func TestSetAliasesConcurrent(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	if _, err := conn.Register("name", "v1", "addr"); err != nil {
+		t.Fatalf("Error registering endpoint: %s", err)
+	}
+	assertEventualLookup(t, conn.ZKRegistry, "name", "v1", []string{"addr"}, nil)
+
+	expect := map[string]string{}
+	errs := make(chan error)
+	for i := 0; i < serviceRetries-1; i++ {
+		alias := "alias" + strconv.Itoa(i)
+		expect[alias] = "v1"
+		go func() { errs <- conn.SetAlias("name", alias, "v1") }()
+	}
+	for range expect {
+		if err := <-errs; err != nil {
+			t.Fatalf("Error setting alias: %s", err)
+		}
+	}
+	assertEventualAliases(t, conn.ZKRegistry, "name", expect)
+}
@@ -0,0 +1,166 @@
+package zkregistry
+
+// catalog is an immutable view of the registry state.
+// Each change publishes a new catalog so readers never lock.
+// NOTE: a published catalog and everything it references must never be modified.
+type catalog struct {
+	revision uint64
+	services map[string]map[string]*endpointList
+	aliases  map[string]map[string]string // Version aliases by service name, see SetAliases.
+	splits   map[string]map[string]int    // Traffic splits by service name, see SetSplit.
+	changed  chan struct{}                // Closed when a newer catalog gets published.
+}
+
+// endpointList is an immutable list of endpoints for a service name/version.
+type endpointList struct {
+	endpoints []string   // Addresses, in the same order as instances.
+	instances []Instance // Addresses along with their metadata.
+}
+
+// newCatalog creates an empty catalog.
+func newCatalog() *catalog {
+	return &catalog{
+		services: map[string]map[string]*endpointList{},
+		aliases:  map[string]map[string]string{},
+		splits:   map[string]map[string]int{},
+		changed:  make(chan struct{}),
+	}
+}
+
+// newEndpointList creates an endpoint list from the given instances.
+// NOTE: takes ownership of the given slice.
+func newEndpointList(instances []Instance) *endpointList {
+	list := &endpointList{
+		endpoints: make([]string, 0, len(instances)),
+		instances: instances,
+	}
+	for _, instance := range instances {
+		list.endpoints = append(list.endpoints, instance.Address)
+	}
+	return list
+}
+
+// contains returns whether the list holds the given endpoint.
+func (list *endpointList) contains(endpoint string) bool {
+	for _, e := range list.endpoints {
+		if e == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the endpoint list for the given service name/version.
+func (c *catalog) lookup(name, version string) (*endpointList, bool) {
+	list, ok := c.services[name][version]
+	return list, ok
+}
+
+// resolve returns the version the given service name/version designates:
+// the version itself if known, or the target of the alias.
+func (c *catalog) resolve(name, version string) string {
+	if _, ok := c.services[name][version]; ok {
+		return version
+	}
+	if target, ok := c.aliases[name][version]; ok {
+		return target
+	}
+	return version
+}
+
+// withVersion returns a copy of the catalog with the given endpoint list for the service name/version.
+// A nil list removes the version.
+// Only the maps on the path of the change are copied, the rest is shared.
+func (c *catalog) withVersion(name, version string, list *endpointList) *catalog {
+	next := &catalog{
+		services: make(map[string]map[string]*endpointList, len(c.services)+1),
+		aliases:  c.aliases,
+		splits:   c.splits,
+	}
+	for k, v := range c.services {
+		next.services[k] = v
+	}
+
+	versions := make(map[string]*endpointList, len(c.services[name])+1)
+	for k, v := range c.services[name] {
+		versions[k] = v
+	}
+	if list == nil {
+		delete(versions, version)
+	} else {
+		versions[version] = list
+	}
+	next.services[name] = versions
+	return next
+}
+
+// withoutService returns a copy of the catalog without the given service.
+func (c *catalog) withoutService(name string) *catalog {
+	next := &catalog{
+		services: make(map[string]map[string]*endpointList, len(c.services)),
+		aliases:  c.aliases,
+		splits:   c.splits,
+	}
+	for k, v := range c.services {
+		if k != name {
+			next.services[k] = v
+		}
+	}
+	return next
+}
+
+// withAliases returns a copy of the catalog with the given aliases for the service.
+// Nil aliases remove them.
+// NOTE: takes ownership of the given map.
+func (c *catalog) withAliases(name string, aliases map[string]string) *catalog {
+	next := &catalog{
+		services: c.services,
+		aliases:  make(map[string]map[string]string, len(c.aliases)+1),
+		splits:   c.splits,
+	}
+	for k, v := range c.aliases {
+		if k != name {
+			next.aliases[k] = v
+		}
+	}
+	if aliases != nil {
+		next.aliases[name] = aliases
+	}
+	return next
+}
+
+// catalog returns the current registry catalog.
+func (reg *ZKRegistry) catalog() *catalog {
+	return reg.state.Load().(*catalog)
+}
+
+// commitLocked publishes the given catalog, bumps the revision
+// and wakes up everyone waiting for a change.
+// NOTE: expects reg.lock to be held.
+func (reg *ZKRegistry) commitLocked(next *catalog) {
+	current := reg.catalog()
+	next.revision = current.revision + 1
+	next.changed = make(chan struct{})
+	reg.state.Store(next)
+	close(current.changed)
+}
+
+// withSplit returns a copy of the catalog with the given traffic split for the service.
+// A nil split removes it.
+// NOTE: takes ownership of the given map.
+func (c *catalog) withSplit(name string, split map[string]int) *catalog {
+	next := &catalog{
+		services: c.services,
+		aliases:  c.aliases,
+		splits:   make(map[string]map[string]int, len(c.splits)+1),
+	}
+	for k, v := range c.splits {
+		if k != name {
+			next.splits[k] = v
+		}
+	}
+	if split != nil {
+		next.splits[name] = split
+	}
+	return next
+}
@@ -0,0 +1,178 @@
+package zkregistry
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestRegistry creates a registry without zookeeper, only usable for the in-memory state.
+func newTestRegistry() *ZKRegistry {
+	reg := &ZKRegistry{
+		outlierConfig: DefaultOutlierDetection,
+		outliers:      map[endpointKey]*outlierState{},
+		local:         map[endpointKey]bool{},
+		subscriptions: map[*Subscription]struct{}{},
+	}
+	reg.state.Store(newCatalog())
+	reg.ejected.Store(map[endpointKey]time.Time{})
+	reg.ejectedChange.Store(make(chan struct{}))
+	return reg
+}
+
+func TestCatalogCopyOnWrite(t *testing.T) {
+	reg := newTestRegistry()
+	reg.Add("name", "v1", "addr1")
+	reg.Add("other", "v1", "addr2")
+
+	before := reg.catalog()
+	endpoints, err := reg.Lookup("name", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg.Add("name", "v1", "addr3")
+	reg.Add("name", "v2", "addr4")
+	reg.DeleteService("other")
+
+	// The previous catalog and the returned slice must be untouched.
+	if expect := []string{"addr1"}; !reflect.DeepEqual(expect, endpoints) {
+		t.Fatalf("Unexpected endpoints.\nExpect:\t%v\nGot:\t%v", expect, endpoints)
+	}
+	if list, ok := before.lookup("name", "v1"); !ok || !reflect.DeepEqual([]string{"addr1"}, list.endpoints) {
+		t.Fatalf("Previous catalog modified: %v", before.services)
+	}
+	if _, ok := before.lookup("name", "v2"); ok {
+		t.Fatal("Previous catalog should not have the new version")
+	}
+	if _, ok := before.services["other"]; !ok {
+		t.Fatal("Previous catalog should still have the deleted service")
+	}
+
+	after := reg.catalog()
+	if expect, got := before.revision+3, after.revision; expect != got {
+		t.Fatalf("Unexpected revision.\nExpect:\t%d\nGot:\t%d", expect, got)
+	}
+	if list, _ := after.lookup("name", "v1"); !reflect.DeepEqual([]string{"addr1", "addr3"}, list.endpoints) {
+		t.Fatalf("Unexpected endpoints in the new catalog: %v", list.endpoints)
+	}
+
+	// The previous catalog signals the change.
+	select {
+	case <-before.changed:
+	default:
+		t.Fatal("The previous catalog should be marked as changed")
+	}
+	select {
+	case <-after.changed:
+		t.Fatal("The current catalog should not be marked as changed")
+	default:
+	}
+}
+
+func TestCatalogNoopChange(t *testing.T) {
+	reg := newTestRegistry()
+	reg.Add("name", "v1", "addr1")
+
+	before := reg.catalog()
+	reg.DeleteEndpoint("name", "v2", "addr1")
+	reg.DeleteEndpoint("name", "v1", "unknown")
+	reg.DeleteVersion("name", "v2")
+	reg.DeleteService("unknown")
+	reg.setMetadata("name", "v1", "unknown", Metadata{Zone: "a"})
+
+	if before != reg.catalog() {
+		t.Fatal("No-op changes should not publish a new catalog")
+	}
+}
+
+// legacyRegistry is the RWMutex based state the catalog replaced, kept for benchmark comparison.
+type legacyRegistry struct {
+	lock     sync.RWMutex
+	services map[string]map[string][]string
+}
+
+func (reg *legacyRegistry) Lookup(name, version string) ([]string, error) {
+	reg.lock.RLock()
+	defer reg.lock.RUnlock()
+
+	targets, ok := reg.services[name][version]
+	if !ok {
+		return nil, ErrServiceNotFound
+	}
+	return targets, nil
+}
+
+func (reg *legacyRegistry) Add(name, version, endpoint string) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	if _, ok := reg.services[name]; !ok {
+		reg.services[name] = map[string][]string{}
+	}
+	reg.services[name][version] = append(reg.services[name][version], endpoint)
+}
+
+func (reg *legacyRegistry) DeleteEndpoint(name, version, endpoint string) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	targets := reg.services[name][version]
+	for i, target := range targets {
+		if target == endpoint {
+			reg.services[name][version] = append(targets[:i:i], targets[i+1:]...)
+			return
+		}
+	}
+}
+
+type benchRegistry interface {
+	Lookup(name, version string) ([]string, error)
+	Add(name, version, endpoint string)
+	DeleteEndpoint(name, version, endpoint string)
+}
+
+// benchmarkLookup runs parallel lookups while a writer keeps changing the registry.
+func benchmarkLookup(b *testing.B, reg benchRegistry) {
+	for i := 0; i < 100; i++ {
+		reg.Add(fmt.Sprintf("service%d", i%10), "version", fmt.Sprintf("addr%d", i))
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			reg.Add("service0", "version", "churn")
+			reg.DeleteEndpoint("service0", "version", "churn")
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := reg.Lookup("service1", "version"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.StopTimer()
+
+	close(stop)
+	<-done
+}
+
+func BenchmarkLookupLegacy(b *testing.B) {
+	benchmarkLookup(b, &legacyRegistry{services: map[string]map[string][]string{}})
+}
+
+func BenchmarkLookup(b *testing.B) {
+	benchmarkLookup(b, newTestRegistry())
+}
@@ -0,0 +1,128 @@
+package zkregistry
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// curatorLayout is the Apache Curator x-discovery layout: /<name>/<instance id>
+// with a JSON ServiceInstance as node data.
+// Curator has no versions: the version and the metadata are stored in the payload
+// as a JSON object, i.e. {"version": "v1", "zone": "us-east-1a"}.
+// Instances without version in their payload are listed under the empty version.
+type curatorLayout struct{}
+
+// curatorInstance is the JSON form of the Curator ServiceInstance.
+type curatorInstance struct {
+	Name                string          `json:"name"`
+	ID                  string          `json:"id"`
+	Address             string          `json:"address"`
+	Port                *int            `json:"port"`
+	SSLPort             *int            `json:"sslPort"`
+	Payload             json.RawMessage `json:"payload"`
+	RegistrationTimeUTC int64           `json:"registrationTimeUTC"`
+	ServiceType         string          `json:"serviceType"`
+	URISpec             json.RawMessage `json:"uriSpec"`
+	Enabled             *bool           `json:"enabled,omitempty"` // Curator >= 4.0.
+}
+
+// curatorPayload is the payload of the instances registered by the registry.
+type curatorPayload struct {
+	Version string `json:"version,omitempty"`
+	Metadata
+}
+
+func (curatorLayout) Depth() int { return 2 }
+
+func (curatorLayout) Parse(elems []string) (Key, error) {
+	switch len(elems) {
+	case 0:
+		return Key{}, nil
+	case 1:
+		return Key{Name: elems[0]}, nil
+	case 2:
+		return Key{Name: elems[0], Endpoint: elems[1]}, nil
+	default:
+		return Key{}, fmt.Errorf("invalid curator path: %q", elems)
+	}
+}
+
+func (curatorLayout) Decode(key Key, data []byte) ([]Entry, error) {
+	var instance curatorInstance
+	if err := json.Unmarshal(data, &instance); err != nil {
+		return nil, fmt.Errorf("invalid curator instance: %s", err)
+	}
+	if instance.Enabled != nil && !*instance.Enabled {
+		return nil, nil
+	}
+	port := instance.Port
+	if port == nil {
+		port = instance.SSLPort
+	}
+	if instance.Address == "" || port == nil {
+		return nil, fmt.Errorf("invalid curator instance: missing address or port")
+	}
+
+	// The payload is free form, only use it if it looks like ours.
+	var payload curatorPayload
+	_ = json.Unmarshal(instance.Payload, &payload) // Best effort.
+
+	return []Entry{{
+		Key: Key{
+			Name:     key.Name,
+			Version:  payload.Version,
+			Endpoint: net.JoinHostPort(instance.Address, strconv.Itoa(*port)),
+		},
+		Metadata: payload.Metadata,
+	}}, nil
+}
+
+func (curatorLayout) Node(key Key) ([]string, error) {
+	id, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	return []string{key.Name, id}, nil
+}
+
+func (curatorLayout) Encode(key Key, node string, meta Metadata) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(key.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid curator endpoint %q: %s", key.Endpoint, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid curator endpoint %q: %s", key.Endpoint, err)
+	}
+	payload, err := json.Marshal(curatorPayload{Version: key.Version, Metadata: meta})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&curatorInstance{ // NOTE: pointer for the json.RawMessage fields.
+		Name:                key.Name,
+		ID:                  node,
+		Address:             host,
+		Port:                &port,
+		Payload:             payload,
+		RegistrationTimeUTC: time.Now().UnixNano() / int64(time.Millisecond),
+		ServiceType:         "DYNAMIC",
+		URISpec:             json.RawMessage("null"),
+	})
+}
+
+func (curatorLayout) Flags() int32 { return 0 }
+
+// newUUID generates a random (version 4) UUID, as used by Curator for the instance ids.
+func newUUID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("error generating uuid: %s", err)
+	}
+	buf[6] = buf[6]&0x0f | 0x40
+	buf[8] = buf[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", buf[0:4], buf[4:6], buf[6:8], buf[8:10], buf[10:]), nil
+}
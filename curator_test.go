@@ -0,0 +1,190 @@
+package zkregistry
+
+import (
+	"encoding/json"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// jvmInstance is a ServiceInstance as registered by Curator with a custom payload class.
+const jvmInstance = `{
+	"name": "name",
+	"id": "0a7b9d2e-5c1f-4e3a-9b8d-7f6e5d4c3b2a",
+	"address": "10.0.0.1",
+	"port": 8080,
+	"sslPort": null,
+	"payload": {"@class": "com.example.InstanceDetails", "description": "jvm service"},
+	"registrationTimeUTC": 1475000000000,
+	"serviceType": "DYNAMIC",
+	"uriSpec": {"parts": [{"value": "scheme", "variable": true}]}
+}`
+
+func TestCuratorDecode(t *testing.T) {
+	key := Key{Name: "name", Endpoint: "0a7b9d2e-5c1f-4e3a-9b8d-7f6e5d4c3b2a"}
+	for _, elem := range []struct {
+		data    string
+		expect  []Entry
+		invalid bool
+	}{
+		{data: jvmInstance, expect: []Entry{{Key: Key{Name: "name", Endpoint: "10.0.0.1:8080"}}}},
+		{
+			data:   `{"address": "10.0.0.2", "port": 80, "payload": {"version": "v1", "zone": "a", "weight": 2}}`,
+			expect: []Entry{{Key: Key{Name: "name", Version: "v1", Endpoint: "10.0.0.2:80"}, Metadata: Metadata{Zone: "a", Weight: 2}}},
+		},
+		{data: `{"address": "::1", "sslPort": 443, "payload": "opaque"}`, expect: []Entry{{Key: Key{Name: "name", Endpoint: "[::1]:443"}}}},
+		{data: `{"address": "10.0.0.1", "port": 8080, "enabled": false}`},
+		{data: `{"address": "10.0.0.1", "port": 8080, "enabled": true}`, expect: []Entry{{Key: Key{Name: "name", Endpoint: "10.0.0.1:8080"}}}},
+		{data: `{"address": "10.0.0.1"}`, invalid: true},
+		{data: `invalid`, invalid: true},
+		{data: ``, invalid: true},
+	} {
+		got, err := curatorLayout{}.Decode(key, []byte(elem.data))
+		if elem.invalid != (err != nil) {
+			t.Errorf("[%s] Unexpected error: %v", elem.data, err)
+			continue
+		}
+		if !reflect.DeepEqual(elem.expect, got) {
+			t.Errorf("[%s] Unexpected entries.\nExpect:\t%v\nGot:\t%v", elem.data, elem.expect, got)
+		}
+	}
+}
+
+func TestCuratorEncode(t *testing.T) {
+	l := curatorLayout{}
+	key := Key{Name: "name", Version: "v1", Endpoint: "127.0.0.1:9000"}
+	elems, err := l.Node(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(elems) != 2 || elems[0] != "name" || !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(elems[1]) {
+		t.Fatalf("Unexpected node: %v", elems)
+	}
+	meta := Metadata{Zone: "a", Tags: []string{"canary"}}
+	data, err := l.Encode(key, elems[1], meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fields expected by Curator.
+	var instance map[string]interface{}
+	if err := json.Unmarshal(data, &instance); err != nil {
+		t.Fatal(err)
+	}
+	for field, expect := range map[string]interface{}{
+		"name":        "name",
+		"id":          elems[1],
+		"address":     "127.0.0.1",
+		"port":        9000.,
+		"sslPort":     nil,
+		"serviceType": "DYNAMIC",
+		"uriSpec":     nil,
+		"payload":     map[string]interface{}{"version": "v1", "zone": "a", "tags": []interface{}{"canary"}},
+	} {
+		if got := instance[field]; !reflect.DeepEqual(expect, got) {
+			t.Errorf("Unexpected %s.\nExpect:\t%v\nGot:\t%v", field, expect, got)
+		}
+	}
+	if ts, ok := instance["registrationTimeUTC"].(float64); !ok || ts < 1e12 {
+		t.Errorf("Unexpected registration time: %v", instance["registrationTimeUTC"])
+	}
+
+	// Round trip.
+	got, err := l.Decode(Key{Name: "name", Endpoint: elems[1]}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := []Entry{{Key: key, Metadata: meta}}; !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected entries.\nExpect:\t%v\nGot:\t%v", expect, got)
+	}
+
+	if _, err := l.Encode(Key{Name: "name", Endpoint: "addr"}, elems[1], meta); err == nil {
+		t.Fatal("Endpoints without port should fail")
+	}
+}
+
+func TestCuratorRegistry(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	assertCreateTree(t, conn, "/curator/name")
+	jvmPath := path.Join(conn.prefix, "/curator/name/0a7b9d2e-5c1f-4e3a-9b8d-7f6e5d4c3b2a")
+	if _, err := conn.conn.Create(jvmPath, []byte(jvmInstance), 0, zk.WorldACL(zk.PermAll)); err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := New(conn.conn, path.Join(conn.prefix, "/curator"), discardLogger, WithCuratorLayout(), WithTickInterval(20*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Error creating the registry: %s", err)
+	}
+	defer func() { _ = reg.Close() }() // Best effort.
+
+	// Existing JVM instances are found without version.
+	assertEventualLookup(t, reg, "name", "", []string{"10.0.0.1:8080"}, nil)
+
+	r, err := reg.RegisterInstance("name", "v1", Instance{Address: "127.0.0.1:9000", Metadata: Metadata{Zone: "a"}})
+	if err != nil {
+		t.Fatalf("Error registering Endpoint: %s", err)
+	}
+	if dir, id := path.Split(r.Path()); dir != path.Join(conn.prefix, "/curator/name")+"/" || len(id) != 36 {
+		t.Fatalf("Unexpected registration path: %s", r.Path())
+	}
+	if _, stat, err := conn.conn.Exists(r.Path()); err != nil || stat.EphemeralOwner == 0 {
+		t.Fatalf("Registered endpoint should be an ephemeral node (%v)", err)
+	}
+	assertEventualLookup(t, reg, "name", "v1", []string{"127.0.0.1:9000"}, nil)
+	if instances, err := reg.LookupInstances("name", "v1"); err != nil || instances[0].Metadata.Zone != "a" {
+		t.Fatalf("Unexpected instances: %v (%v)", instances, err)
+	}
+
+	// Metadata updates rewrite the instance.
+	if err := r.SetMetadata(Metadata{Zone: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	data, _, err := conn.conn.Get(r.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"id":"`+path.Base(r.Path())+`"`) || !strings.Contains(string(data), `"zone":"b"`) {
+		t.Fatalf("Unexpected instance data: %s", data)
+	}
+
+	// Disabled instances are skipped, versions go away with their last instance.
+	if _, err := conn.conn.Set(jvmPath, []byte(`{"address": "10.0.0.1", "port": 8080, "enabled": false}`), -1); err != nil {
+		t.Fatal(err)
+	}
+	assertEventualLookup(t, reg, "name", "", nil, ErrServiceNotFound)
+
+	if err := r.Deregister(); err != nil {
+		t.Fatal(err)
+	}
+	assertEventualLookup(t, reg, "name", "v1", nil, ErrServiceNotFound)
+	if versions, err := reg.Versions("name"); err != nil || len(versions) != 0 {
+		t.Fatalf("The service should be known without versions: %v (%v)", versions, err)
+	}
+
+	if err := conn.conn.Delete(jvmPath, -1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.conn.Create(jvmPath, []byte(jvmInstance), 0, zk.WorldACL(zk.PermAll)); err != nil {
+		t.Fatal(err)
+	}
+	assertEventualLookup(t, reg, "name", "", []string{"10.0.0.1:8080"}, nil)
+
+	// Once settled, the periodic reconciliation agrees with the events.
+	time.Sleep(50 * time.Millisecond)
+	before := reg.Stats()
+	time.Sleep(100 * time.Millisecond)
+	after := reg.Stats()
+	if after.Reconciliations == before.Reconciliations {
+		t.Fatal("The registry should have been reconciled")
+	}
+	if after.ReconcileAdded != before.ReconcileAdded || after.ReconcileRemoved != before.ReconcileRemoved || after.ReconcileUpdated != before.ReconcileUpdated {
+		t.Fatalf("Reconciliation should not find any drift.\nBefore:\t%+v\nAfter:\t%+v", before, after)
+	}
+}
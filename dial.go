@@ -0,0 +1,95 @@
+package zkregistry
+
+import (
+	"fmt"
+	stdLog "log"
+	"os"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// DefaultSessionTimeout is the zookeeper session timeout used by Dial.
+var DefaultSessionTimeout = 10 * time.Second
+
+// credential is a zookeeper authentication, see WithAuth.
+type credential struct {
+	scheme string
+	auth   []byte
+}
+
+// dialConfig holds the connection settings used by Dial.
+type dialConfig struct {
+	sessionTimeout time.Duration
+	credentials    []credential
+	dialer         zk.Dialer
+}
+
+// Dial connects to the given zookeeper servers and creates a registry owning the connection:
+// the credentials are re-applied after each reconnection and Close closes the connection.
+// Use New to share a connection between several registries.
+func Dial(servers []string, zkPath string, opts ...Option) (*ZKRegistry, error) {
+	// Collect the connection settings first, the options are applied again by New.
+	probe := &ZKRegistry{dial: dialConfig{sessionTimeout: DefaultSessionTimeout}}
+	for _, opt := range opts {
+		opt(probe)
+	}
+	logger := probe.logger
+	if logger == nil {
+		logger = stdLog.New(os.Stderr, "", stdLog.LstdFlags)
+	}
+
+	conn, events, err := zk.ConnectWithDialer(servers, probe.dial.sessionTimeout, probe.dial.dialer)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetLogger(logger)
+
+	for _, cred := range probe.dial.credentials {
+		if err := conn.AddAuth(cred.scheme, cred.auth); err != nil {
+			if probe.snapshotFile == "" {
+				conn.Close()
+				return nil, fmt.Errorf("error adding %s credentials: %s", cred.scheme, err)
+			}
+			// Degraded start, the credentials get applied once connected.
+			logger.Printf("error adding %s credentials: %s", cred.scheme, err)
+		}
+	}
+
+	// Follow the session before New, the credentials must survive the reconnections during the startup too.
+	sessionDone := make(chan struct{})
+	go func() {
+		defer close(sessionDone)
+		followSession(conn, events, probe.dial.credentials, logger)
+	}()
+
+	reg, err := New(conn, zkPath, logger, opts...)
+	if err != nil {
+		conn.Close()
+		<-sessionDone
+		return nil, err
+	}
+	reg.ownConn = true
+	reg.sessionDone = sessionDone
+	return reg, nil
+}
+
+// followSession follows the zookeeper session state until the connection gets closed and re-applies
+// the credentials on reconnection, zookeeper only keeps them for the lifetime of a connection.
+func followSession(conn *zk.Conn, events <-chan zk.Event, credentials []credential, logger zk.Logger) {
+	for event := range events {
+		if event.Type != zk.EventSession {
+			continue
+		}
+
+		logger.Printf("Zookeeper session state: %s", event.State)
+		if event.State != zk.StateHasSession {
+			continue
+		}
+		for _, cred := range credentials {
+			if err := conn.AddAuth(cred.scheme, cred.auth); err != nil {
+				logger.Printf("error adding %s credentials: %s", cred.scheme, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package zkregistry
+
+import (
+	"net"
+	"path"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// Make sure the registry owns the connection it dialed.
+func TestDial(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	reg, err := Dial([]string{testZKHost}, path.Join(conn.prefix, "/test/discovery"), WithLogger(discardLogger), WithSessionTimeout(1*time.Second))
+	if err != nil {
+		t.Fatalf("Error dialing the registry: %s", err)
+	}
+	if _, err := reg.Register("name", "version", "addr"); err != nil {
+		t.Fatalf("Error registering endpoint: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got, err := reg.Lookup("name", "version"); err != nil {
+		t.Fatalf("Error looking up the registry: %s", err)
+	} else if expect := []string{"addr"}; !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected endpoints.\nExpect:\t%v\nGot:\t%v", expect, got)
+	}
+
+	if err := reg.Close(); err != nil {
+		t.Fatalf("Error closing the registry: %s", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for reg.conn.State() != zk.StateDisconnected {
+		if time.Now().After(deadline) {
+			t.Fatalf("The connection should be closed along with the registry, state: %s", reg.conn.State())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDialInvalid(t *testing.T) {
+	if _, err := Dial([]string{}, "/test/discovery", WithLogger(discardLogger)); err == nil {
+		t.Fatal("Dial without servers should fail")
+	}
+}
+
+// Make sure the credentials survive a reconnection.
+func TestDialAuth(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	p := newTCPProxy(t, testZKHost)
+	p.Start()
+	defer p.Stop()
+
+	var dials int32
+	dialer := func(network, address string, timeout time.Duration) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return net.DialTimeout(network, address, timeout)
+	}
+
+	reg, err := Dial([]string{p.URL}, path.Join(conn.prefix, "/test/discovery"),
+		WithLogger(discardLogger),
+		WithSessionTimeout(2*time.Second),
+		WithAuth("digest", []byte("user:password")),
+		WithDialer(dialer),
+	)
+	if err != nil {
+		t.Fatalf("Error dialing the registry: %s", err)
+	}
+	defer func() { _ = reg.Close() }() // Best effort.
+
+	protected := path.Join(conn.prefix, "/test/protected")
+	if _, err := reg.conn.Create(protected, []byte("secret"), 0, zk.DigestACL(zk.PermAll, "user", "password")); err != nil {
+		t.Fatalf("Error creating protected node: %s", err)
+	}
+	defer func() { _ = reg.conn.Delete(protected, -1) }() // Best effort.
+
+	if _, _, err := reg.conn.Get(protected); err != nil {
+		t.Fatalf("Error reading protected node: %s", err)
+	}
+	if _, _, err := conn.conn.Get(protected); err != zk.ErrNoAuth {
+		t.Fatalf("Unexpected error.\nExpect:\t%v\nGot:\t%v", zk.ErrNoAuth, err)
+	}
+
+	// Cut the connection, the session survives but the credentials have to be sent again.
+	p.Stop()
+	p.Start()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, _, err = reg.conn.Get(protected); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Error reading protected node after reconnection: %s", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&dials); n < 2 {
+		t.Fatalf("The custom dialer should have been used to reconnect, got %d dials", n)
+	}
+}
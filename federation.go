@@ -0,0 +1,347 @@
+package zkregistry
+
+import (
+	"errors"
+	"fmt"
+	stdLog "log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// Backoff bounds between the attempts to create the registry of a failed source.
+var (
+	sourceMinBackoff = 100 * time.Millisecond
+	sourceMaxBackoff = 30 * time.Second
+)
+
+// Source describes one of the registries of a Federation, i.e. one per zookeeper ensemble.
+type Source struct {
+	Label    string // Unique name of the source, i.e. the datacenter.
+	Priority int    // Lower is preferred: the local source should have the lowest priority.
+	Conn     *zk.Conn
+	ZKPath   string
+	Options  []Option
+}
+
+// SourcedInstance is an instance along with the label of the source it comes from.
+type SourcedInstance struct {
+	Instance
+	Source string `json:"source"`
+}
+
+// federatedSource is a source of a Federation.
+type federatedSource struct {
+	label    string
+	priority int
+	config   Source
+
+	lock sync.Mutex
+	reg  *ZKRegistry // Nil until created. Protected by lock.
+	err  error       // Last creation error. Protected by lock.
+}
+
+// registry returns the registry of the source, nil if not created yet.
+func (s *federatedSource) registry() *ZKRegistry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.reg
+}
+
+// start creates the registry of the source, see New.
+func (s *federatedSource) start(logger zk.Logger) error {
+	reg, err := New(s.config.Conn, s.config.ZKPath, logger, s.config.Options...)
+	s.lock.Lock()
+	s.reg, s.err = reg, err
+	s.lock.Unlock()
+	return err
+}
+
+// Federation merges the catalogs of several registries.
+// Lookups prefer the sources with the lowest priority and fail over to
+// the next ones when a service has no endpoint there.
+// Each source keeps its own state and health.
+type Federation struct {
+	sources []*federatedSource // Sorted by priority.
+	logger  zk.Logger
+
+	// Internal controls.
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Federation errors.
+var (
+	ErrNoSources = errors.New("federation requires at least one source")
+)
+
+// NewFederation creates a registry for each of the given sources.
+// The sources start independently: the ones failing to start are reported in Health
+// and retried in background until they succeed, see New.
+func NewFederation(logger zk.Logger, sources ...Source) (*Federation, error) {
+	if len(sources) == 0 {
+		return nil, ErrNoSources
+	}
+	labels := map[string]struct{}{}
+	for _, source := range sources {
+		if source.Label == "" {
+			return nil, fmt.Errorf("empty source label")
+		}
+		if _, ok := labels[source.Label]; ok {
+			return nil, fmt.Errorf("duplicate source label: %q", source.Label)
+		}
+		labels[source.Label] = struct{}{}
+		if source.Conn == nil {
+			return nil, fmt.Errorf("source %q: %s", source.Label, ErrNilConn)
+		}
+	}
+
+	if logger == nil {
+		logger = stdLog.New(os.Stderr, "", stdLog.LstdFlags)
+	}
+	fed := &Federation{logger: logger, stopChan: make(chan struct{})}
+	for _, source := range sources {
+		fed.sources = append(fed.sources, &federatedSource{label: source.Label, priority: source.Priority, config: source})
+	}
+	sort.Stable(byPriority(fed.sources))
+
+	for _, source := range fed.sources {
+		if err := source.start(logger); err != nil {
+			fed.logger.Printf("error starting source %q, retrying in background: %s", source.label, err)
+			fed.wg.Add(1)
+			go func(source *federatedSource) {
+				defer fed.wg.Done()
+				fed.retry(source)
+			}(source)
+		}
+	}
+	return fed, nil
+}
+
+// retry creates the registry of the given failed source until it succeeds or the federation is closed.
+func (fed *Federation) retry(source *federatedSource) {
+	backoff := sourceMinBackoff
+	for {
+		select {
+		case <-fed.stopChan:
+			return
+		case <-time.After(backoff):
+		}
+		err := source.start(fed.logger)
+		if err == nil {
+			fed.logger.Printf("Source %q started", source.label)
+			return
+		}
+		if backoff *= 2; backoff > sourceMaxBackoff {
+			backoff = sourceMaxBackoff
+		}
+		fed.logger.Printf("error starting source %q, retrying in %s: %s", source.label, backoff, err)
+	}
+}
+
+// byPriority sorts the sources by priority.
+type byPriority []*federatedSource
+
+func (s byPriority) Len() int           { return len(s) }
+func (s byPriority) Less(i, j int) bool { return s[i].priority < s[j].priority }
+func (s byPriority) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Close stops the retries and terminates the registries of all the sources.
+func (fed *Federation) Close() error {
+	close(fed.stopChan)
+	fed.wg.Wait()
+
+	var err error
+	for _, source := range fed.sources {
+		reg := source.registry()
+		if reg == nil {
+			continue
+		}
+		if e := reg.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Registry returns the registry of the given source, nil if unknown or not started yet.
+func (fed *Federation) Registry(label string) *ZKRegistry {
+	for _, source := range fed.sources {
+		if source.label == label {
+			return source.registry()
+		}
+	}
+	return nil
+}
+
+// Health returns the health of each source by label.
+// The sources not started yet are reported with their zookeeper session state and the error.
+func (fed *Federation) Health() map[string]Health {
+	ret := make(map[string]Health, len(fed.sources))
+	for _, source := range fed.sources {
+		source.lock.Lock()
+		reg, err := source.reg, source.err
+		source.lock.Unlock()
+		if reg != nil {
+			ret[source.label] = reg.Health()
+			continue
+		}
+		state := source.config.Conn.State()
+		ret[source.label] = Health{State: state.String(), Connected: state == zk.StateHasSession, Error: err.Error()}
+	}
+	return ret
+}
+
+// Failure reports the failure of the given endpoint to the sources listing it, see ZKRegistry.Failure.
+func (fed *Federation) Failure(name, version, endpoint string, err error) {
+	for _, reg := range fed.owners(name, version, endpoint) {
+		reg.Failure(name, version, endpoint, err)
+	}
+}
+
+// Success reports the success of the given endpoint to the sources listing it, see ZKRegistry.Success.
+func (fed *Federation) Success(name, version, endpoint string) {
+	for _, reg := range fed.owners(name, version, endpoint) {
+		reg.Success(name, version, endpoint)
+	}
+}
+
+// owners returns the registries of the sources listing the given endpoint.
+// The same address in several sources is the same endpoint, all of them get the report.
+func (fed *Federation) owners(name, version, endpoint string) []*ZKRegistry {
+	var ret []*ZKRegistry
+	for _, source := range fed.sources {
+		reg := source.registry()
+		if reg == nil {
+			continue
+		}
+		current := reg.catalog()
+		if list, ok := current.lookup(name, current.resolveEndpoint(name, version, endpoint)); ok && list.contains(endpoint) {
+			ret = append(ret, reg)
+		}
+	}
+	return ret
+}
+
+// LookupInstances returns the endpoints of the service name/version from the preferred sources:
+// the sources with the lowest priority having endpoints for it.
+// Sources sharing a priority are merged.
+func (fed *Federation) LookupInstances(name, version string) ([]SourcedInstance, error) {
+	found := false
+	var ret []SourcedInstance
+	for i, source := range fed.sources {
+		if reg := source.registry(); reg != nil {
+			if instances, err := reg.LookupInstances(name, version); err == nil {
+				found = true
+				for _, instance := range instances {
+					ret = append(ret, SourcedInstance{Instance: instance, Source: source.label})
+				}
+			}
+		}
+		// Stop at the end of the first priority level with endpoints.
+		if len(ret) > 0 && (i == len(fed.sources)-1 || fed.sources[i+1].priority != source.priority) {
+			break
+		}
+	}
+	if !found {
+		return nil, ErrServiceNotFound
+	}
+	if ret == nil {
+		ret = []SourcedInstance{}
+	}
+	return ret, nil
+}
+
+// Lookup returns the endpoint list of the service name/version from the preferred sources, see LookupInstances.
+func (fed *Federation) Lookup(name, version string) ([]string, error) {
+	instances, err := fed.LookupInstances(name, version)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]string, 0, len(instances))
+	seen := make(map[string]struct{}, len(instances))
+	for _, instance := range instances {
+		if _, ok := seen[instance.Address]; ok {
+			continue
+		}
+		seen[instance.Address] = struct{}{}
+		ret = append(ret, instance.Address)
+	}
+	return ret, nil
+}
+
+// LookupAll returns the endpoints of the service name/version from all the sources, by priority.
+func (fed *Federation) LookupAll(name, version string) ([]SourcedInstance, error) {
+	found := false
+	ret := []SourcedInstance{}
+	for _, source := range fed.sources {
+		reg := source.registry()
+		if reg == nil {
+			continue
+		}
+		instances, err := reg.LookupInstances(name, version)
+		if err != nil {
+			continue
+		}
+		found = true
+		for _, instance := range instances {
+			ret = append(ret, SourcedInstance{Instance: instance, Source: source.label})
+		}
+	}
+	if !found {
+		return nil, ErrServiceNotFound
+	}
+	return ret, nil
+}
+
+// Services returns the sorted list of the service names known by any source.
+func (fed *Federation) Services() []string {
+	set := map[string]struct{}{}
+	for _, source := range fed.sources {
+		reg := source.registry()
+		if reg == nil {
+			continue
+		}
+		for _, name := range reg.Services() {
+			set[name] = struct{}{}
+		}
+	}
+	return sortedSet(set)
+}
+
+// Versions returns the sorted list of the versions known by any source for the given service name.
+func (fed *Federation) Versions(name string) ([]string, error) {
+	found := false
+	set := map[string]struct{}{}
+	for _, source := range fed.sources {
+		reg := source.registry()
+		if reg == nil {
+			continue
+		}
+		versions, err := reg.Versions(name)
+		if err != nil {
+			continue
+		}
+		found = true
+		for _, version := range versions {
+			set[version] = struct{}{}
+		}
+	}
+	if !found {
+		return nil, ErrServiceNotFound
+	}
+	return sortedSet(set), nil
+}
+
+// sortedSet returns the sorted elements of the given set.
+func sortedSet(set map[string]struct{}) []string {
+	ret := make([]string, 0, len(set))
+	for elem := range set {
+		ret = append(ret, elem)
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,207 @@
+package zkregistry
+
+import (
+	"errors"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// newTestFederation creates a federation with a local source (dc1) and a remote one (dc2).
+func newTestFederation(t *testing.T, conn *zkConn) *Federation {
+	fed, err := NewFederation(discardLogger,
+		Source{Label: "dc2", Priority: 1, Conn: conn.conn, ZKPath: path.Join(conn.prefix, "dc2/discovery")},
+		Source{Label: "dc1", Priority: 0, Conn: conn.conn, ZKPath: path.Join(conn.prefix, "dc1/discovery")},
+	)
+	if err != nil {
+		t.Fatalf("Error creating federation: %s", err)
+	}
+	return fed
+}
+
+func TestFederation(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	fed := newTestFederation(t, conn)
+	defer func() { _ = fed.Close() }() // Best effort.
+
+	assertCreateTree(t, conn, "/dc1/discovery/name/version/local")
+	assertCreateTree(t, conn, "/dc2/discovery/name/version/remote")
+	assertCreateTree(t, conn, "/dc2/discovery/other/version/remote")
+	time.Sleep(100 * time.Millisecond)
+
+	// The local source is preferred.
+	if got, err := fed.Lookup("name", "version"); err != nil {
+		t.Fatalf("Error looking up the federation: %s", err)
+	} else if expect := []string{"local"}; !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected endpoints.\nExpect:\t%v\nGot:\t%v", expect, got)
+	}
+
+	// Fail over when the local source does not know the service.
+	if got, err := fed.LookupInstances("other", "version"); err != nil {
+		t.Fatalf("Error looking up the federation: %s", err)
+	} else if expect := []SourcedInstance{{Instance: Instance{Address: "remote"}, Source: "dc2"}}; !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected instances.\nExpect:\t%v\nGot:\t%v", expect, got)
+	}
+
+	// Fail over when the local source has no endpoint left.
+	assertRemoveTree(t, conn, "/dc1/discovery/name/version/local")
+	time.Sleep(100 * time.Millisecond)
+	if got, err := fed.Lookup("name", "version"); err != nil {
+		t.Fatalf("Error looking up the federation: %s", err)
+	} else if expect := []string{"remote"}; !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected endpoints.\nExpect:\t%v\nGot:\t%v", expect, got)
+	}
+
+	// Unknown everywhere.
+	if _, err := fed.Lookup("unknown", "version"); err != ErrServiceNotFound {
+		t.Fatalf("Unexpected error.\nExpect:\t%v\nGot:\t%v", ErrServiceNotFound, err)
+	}
+	assertRemoveTree(t, conn, "/dc2/discovery/name/version/remote")
+	time.Sleep(100 * time.Millisecond)
+	if got, err := fed.Lookup("name", "version"); err != nil {
+		t.Fatalf("Error looking up the federation: %s", err)
+	} else if len(got) != 0 {
+		t.Fatalf("Unexpected endpoints: %v", got)
+	}
+}
+
+func TestFederationMerge(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	fed := newTestFederation(t, conn)
+	defer func() { _ = fed.Close() }() // Best effort.
+
+	assertCreateTree(t, conn, "/dc1/discovery/name/version1/local")
+	assertCreateTree(t, conn, "/dc2/discovery/name/version1/remote")
+	assertCreateTree(t, conn, "/dc2/discovery/name/version2/remote")
+	assertCreateTree(t, conn, "/dc2/discovery/other/version1/remote")
+	time.Sleep(100 * time.Millisecond)
+
+	got, err := fed.LookupAll("name", "version1")
+	if err != nil {
+		t.Fatalf("Error looking up the federation: %s", err)
+	}
+	expect := []SourcedInstance{
+		{Instance: Instance{Address: "local"}, Source: "dc1"},
+		{Instance: Instance{Address: "remote"}, Source: "dc2"},
+	}
+	if !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected instances.\nExpect:\t%v\nGot:\t%v", expect, got)
+	}
+
+	if expect, got := []string{"name", "other"}, fed.Services(); !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected services.\nExpect:\t%v\nGot:\t%v", expect, got)
+	}
+	if got, err := fed.Versions("name"); err != nil {
+		t.Fatalf("Error looking up the versions: %s", err)
+	} else if expect := []string{"version1", "version2"}; !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected versions.\nExpect:\t%v\nGot:\t%v", expect, got)
+	}
+	if _, err := fed.Versions("unknown"); err != ErrServiceNotFound {
+		t.Fatalf("Unexpected error.\nExpect:\t%v\nGot:\t%v", ErrServiceNotFound, err)
+	}
+
+	health := fed.Health()
+	if len(health) != 2 || !health["dc1"].Connected || !health["dc2"].Connected {
+		t.Fatalf("Unexpected health: %+v", health)
+	}
+	if fed.Registry("dc1") == nil || fed.Registry("unknown") != nil {
+		t.Fatal("Unexpected source registry")
+	}
+}
+
+func TestFederationInvalid(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	if _, err := NewFederation(discardLogger); err != ErrNoSources {
+		t.Fatalf("Unexpected error.\nExpect:\t%v\nGot:\t%v", ErrNoSources, err)
+	}
+	if _, err := NewFederation(discardLogger,
+		Source{Label: "dc1", Conn: conn.conn, ZKPath: path.Join(conn.prefix, "dc1/discovery")},
+		Source{Label: "dc1", Conn: conn.conn, ZKPath: path.Join(conn.prefix, "dc2/discovery")},
+	); err == nil {
+		t.Fatal("Duplicate labels should fail")
+	}
+	if _, err := NewFederation(discardLogger,
+		Source{Label: "dc1", Conn: conn.conn, ZKPath: path.Join(conn.prefix, "dc1/discovery")},
+		Source{Label: "dc2"},
+	); err == nil || err.Error() != `source "dc2": `+ErrNilConn.Error() {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+// Make sure a failed source does not prevent the others from starting, and gets retried.
+func TestFederationSourceRetry(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	// dc2 unreachable at startup.
+	p := newTCPProxy(t, testZKHost)
+	p.Start()
+	p.Stop()
+	proxyConn, _, err := zk.Connect([]string{p.URL}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyConn.Close()
+
+	assertCreateTree(t, conn, "/dc1/discovery/name/version/local")
+	assertCreateTree(t, conn, "/dc2/discovery/name/version/remote1")
+	assertCreateTree(t, conn, "/dc2/discovery/name/version/remote2")
+
+	fed, err := NewFederation(discardLogger,
+		Source{Label: "dc1", Priority: 0, Conn: conn.conn, ZKPath: path.Join(conn.prefix, "dc1/discovery")},
+		Source{Label: "dc2", Priority: 1, Conn: proxyConn, ZKPath: path.Join(conn.prefix, "dc2/discovery")},
+	)
+	if err != nil {
+		t.Fatalf("Error creating federation: %s", err)
+	}
+	defer func() { _ = fed.Close() }() // Best effort.
+
+	if h := fed.Health()["dc2"]; h.Ready() || h.Error == "" {
+		t.Fatalf("The failed source should be reported: %+v", h)
+	}
+	if fed.Registry("dc2") != nil {
+		t.Fatal("The failed source should not have a registry")
+	}
+	assertEventualFederationLookup(t, fed, []string{"local"})
+
+	// Once reachable, the source starts.
+	p.Start()
+	defer p.Stop()
+	for deadline := time.Now().Add(5 * time.Second); fed.Registry("dc2") == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("The source should have been started: %+v", fed.Health()["dc2"])
+		}
+	}
+	if h := fed.Health()["dc2"]; h.Error != "" {
+		t.Fatalf("The source should not report an error anymore: %+v", h)
+	}
+	assertEventualLookup(t, fed.Registry("dc2"), "name", "version", []string{"remote1", "remote2"}, nil)
+
+	// The failures go to the source listing the endpoint.
+	fed.Registry("dc2").SetOutlierDetection(OutlierDetection{ConsecutiveFailures: 1, BaseEjectionTime: time.Minute, MaxEjectionPercent: 50})
+	fed.Failure("name", "version", "remote1", errors.New("failure"))
+	assertLookupResult(t, &zkConn{ZKRegistry: fed.Registry("dc2")}, "name", "version", []string{"remote2"}, nil)
+	fed.Success("name", "version", "remote1")
+	assertEventualLookup(t, fed.Registry("dc2"), "name", "version", []string{"remote1", "remote2"}, nil)
+}
+
+// assertEventualFederationLookup waits for the federation to return the expected endpoints.
+func assertEventualFederationLookup(t *testing.T, fed *Federation, expect []string) {
+	file, line := getCaller(t, 1)
+	var got []string
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if got, _ = fed.Lookup("name", "version"); reflect.DeepEqual(expect, got) {
+			return
+		}
+	}
+	t.Fatalf("[%s:%d] Unexpected endpoints.\nExpect:\t%v\nGot:\t%v", file, line, expect, got)
+}
@@ -0,0 +1,245 @@
+package zkregistry
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Consistent hashing settings.
+const (
+	RingReplicas    = 100   // Points of each endpoint on the ring, multiplied by its weight.
+	MaglevTableSize = 65537 // Size of the Maglev lookup table, prime and much larger than the endpoint count.
+	MaxHashWeight   = 100   // Cap on the endpoint weights, bounding the ring to RingReplicas*MaxHashWeight points per endpoint.
+)
+
+// hashTable maps the key hashes to the endpoints of a consistent hash picker.
+type hashTable interface {
+	// update applies the given endpoint list, reusing what does not change.
+	update(instances []Instance)
+	// pick returns the endpoint for the given key hash.
+	// NOTE: expects a non-empty table.
+	pick(h uint64) string
+}
+
+// HashPicker selects the endpoint of a service name/version by consistent hashing of a key:
+// the same key lands on the same endpoint, and the endpoint changes only move a small share of the keys.
+// As for Picker, the endpoint list is looked up on each call, the table being updated when it changes.
+type HashPicker struct {
+	reg     *ZKRegistry
+	name    string
+	version string
+
+	lock      sync.Mutex
+	instances []Instance // Endpoints of the current table.
+	table     hashTable
+}
+
+// RingHashPicker creates a new consistent hash picker for the service name/version using a hash ring,
+// each endpoint owning RingReplicas points per weight unit, up to MaxHashWeight. Adding or removing an endpoint only
+// inserts or removes its own points, only moving the keys it gains or loses.
+func (reg *ZKRegistry) RingHashPicker(name, version string) *HashPicker {
+	return &HashPicker{reg: reg, name: name, version: version, table: &ringTable{}}
+}
+
+// MaglevPicker creates a new consistent hash picker for the service name/version using a Maglev lookup table
+// of MaglevTableSize entries: constant time picks and an even spread, at the cost of slightly more key movement
+// than the ring on endpoint changes.
+func (reg *ZKRegistry) MaglevPicker(name, version string) *HashPicker {
+	return &HashPicker{reg: reg, name: name, version: version, table: &maglevTable{perms: map[string]maglevPerm{}}}
+}
+
+// Pick returns the endpoint for the given key.
+func (p *HashPicker) Pick(key []byte) (string, error) {
+	instances, err := p.reg.LookupInstances(p.name, p.version)
+	if err != nil {
+		return "", err
+	}
+	if len(instances) == 0 {
+		return "", ErrNoEndpoints
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !sameInstances(p.instances, instances) {
+		p.table.update(instances)
+		p.instances = instances
+	}
+	return p.table.pick(hashBytes(key)), nil
+}
+
+// sameInstances checks if the given endpoint lists have the same endpoints and weights, see hashWeight.
+func sameInstances(a, b []Instance) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Address != b[i].Address || hashWeight(a[i]) != hashWeight(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// hashWeight returns the weight of the given instance, capped to MaxHashWeight.
+func hashWeight(instance Instance) int {
+	if w := weight(instance); w < MaxHashWeight {
+		return w
+	}
+	return MaxHashWeight
+}
+
+// hashBytes hashes the given key, see mix64.
+func hashBytes(key []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(key) // Never fails.
+	return mix64(h.Sum64())
+}
+
+// ringPoint is a point of an endpoint on the hash ring.
+type ringPoint struct {
+	hash     uint64
+	endpoint string
+}
+
+// byRingPoint sorts the points of the ring, by endpoint on hash collisions for a stable order.
+type byRingPoint []ringPoint
+
+func (s byRingPoint) Len() int           { return len(s) }
+func (s byRingPoint) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byRingPoint) Less(i, j int) bool { return s[i].less(s[j]) }
+
+// less orders the points of the ring.
+func (p ringPoint) less(other ringPoint) bool {
+	if p.hash != other.hash {
+		return p.hash < other.hash
+	}
+	return p.endpoint < other.endpoint
+}
+
+// ringTable is a hash ring, see RingHashPicker.
+type ringTable struct {
+	points  byRingPoint
+	weights map[string]int // Weight of the endpoints on the ring.
+}
+
+// update removes the points of the gone endpoints and merges the ones of the new endpoints.
+func (r *ringTable) update(instances []Instance) {
+	weights := make(map[string]int, len(instances))
+	for _, instance := range instances {
+		weights[instance.Address] = hashWeight(instance)
+	}
+
+	// Keep the points of the unchanged endpoints,
+	points := make(byRingPoint, 0, len(r.points))
+	for _, point := range r.points {
+		if weights[point.endpoint] == r.weights[point.endpoint] {
+			points = append(points, point)
+		}
+	}
+	// and add the ones of the new or reweighted endpoints.
+	var added byRingPoint
+	for endpoint, w := range weights {
+		if r.weights[endpoint] == w {
+			continue
+		}
+		for i := 0; i < w*RingReplicas; i++ {
+			added = append(added, ringPoint{hash: mix64(hashKey(endpoint, strconv.Itoa(i))), endpoint: endpoint})
+		}
+	}
+	sort.Sort(added)
+
+	r.points = mergePoints(points, added)
+	r.weights = weights
+}
+
+// mergePoints merges the given sorted point lists.
+func mergePoints(a, b byRingPoint) byRingPoint {
+	if len(b) == 0 {
+		return a
+	}
+	ret := make(byRingPoint, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		if b[0].less(a[0]) {
+			ret, b = append(ret, b[0]), b[1:]
+		} else {
+			ret, a = append(ret, a[0]), a[1:]
+		}
+	}
+	return append(append(ret, a...), b...)
+}
+
+// pick returns the endpoint of the first point at or after the given hash, wrapping around.
+func (r *ringTable) pick(h uint64) string {
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].endpoint
+}
+
+// maglevPerm is the permutation of an endpoint over the Maglev table.
+type maglevPerm struct {
+	offset, skip uint64
+}
+
+// maglevTable is a Maglev lookup table, see MaglevPicker.
+type maglevTable struct {
+	entries []string
+	perms   map[string]maglevPerm // Cached permutations of the endpoints.
+}
+
+// update repopulates the table from the cached permutations, computing the ones of the new endpoints only.
+// The endpoints are sorted for every client to get the same table.
+func (m *maglevTable) update(instances []Instance) {
+	sorted := make([]Instance, len(instances))
+	copy(sorted, instances)
+	sort.Sort(byAddress(sorted))
+
+	perms := make(map[string]maglevPerm, len(sorted))
+	for _, instance := range sorted {
+		perm, ok := m.perms[instance.Address]
+		if !ok {
+			perm = maglevPerm{
+				offset: mix64(hashKey(instance.Address, "offset")) % MaglevTableSize,
+				skip:   mix64(hashKey(instance.Address, "skip"))%(MaglevTableSize-1) + 1,
+			}
+		}
+		perms[instance.Address] = perm
+	}
+	m.perms = perms
+
+	// Each endpoint takes turns claiming its next free preferred entry, as many per round as its weight.
+	entries := make([]string, MaglevTableSize)
+	claimed := make([]bool, MaglevTableSize)
+	next := make([]uint64, len(sorted))
+	for filled := 0; filled < MaglevTableSize; {
+		for i := 0; i < len(sorted) && filled < MaglevTableSize; i++ {
+			perm := perms[sorted[i].Address]
+			for w := hashWeight(sorted[i]); w > 0 && filled < MaglevTableSize; w-- {
+				c := (perm.offset + next[i]*perm.skip) % MaglevTableSize
+				for claimed[c] {
+					next[i]++
+					c = (perm.offset + next[i]*perm.skip) % MaglevTableSize
+				}
+				entries[c], claimed[c] = sorted[i].Address, true
+				next[i]++
+				filled++
+			}
+		}
+	}
+	m.entries = entries
+}
+
+// pick returns the endpoint of the table entry of the given hash.
+func (m *maglevTable) pick(h uint64) string {
+	return m.entries[h%MaglevTableSize]
+}
+
+// byAddress sorts the instances by address.
+type byAddress []Instance
+
+func (s byAddress) Len() int           { return len(s) }
+func (s byAddress) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byAddress) Less(i, j int) bool { return s[i].Address < s[j].Address }
@@ -0,0 +1,183 @@
+package zkregistry
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// hashPickers lists the consistent hash pickers under test.
+var hashPickers = map[string]func(reg *ZKRegistry, name, version string) *HashPicker{
+	"ring":   (*ZKRegistry).RingHashPicker,
+	"maglev": (*ZKRegistry).MaglevPicker,
+}
+
+// pickKeys returns the endpoint of each of the given number of keys.
+func pickKeys(t *testing.T, p *HashPicker, n int) []string {
+	file, line := getCaller(t, 1)
+	ret := make([]string, n)
+	for i := range ret {
+		endpoint, err := p.Pick([]byte("key" + strconv.Itoa(i)))
+		if err != nil {
+			t.Fatalf("[%s:%d] Error picking endpoint: %s", file, line, err)
+		}
+		ret[i] = endpoint
+	}
+	return ret
+}
+
+func TestHashPickerRemapping(t *testing.T) {
+	const keys = 20000
+	for kind, newPicker := range hashPickers {
+		reg := newTestRegistry()
+		for i := 0; i < 10; i++ {
+			reg.Add("name", "v1", "addr"+strconv.Itoa(i))
+		}
+		p := newPicker(reg, "name", "v1")
+		before := pickKeys(t, p, keys)
+
+		// Same key, same endpoint, and every endpoint gets a share.
+		if again := pickKeys(t, p, keys); !reflect.DeepEqual(before, again) {
+			t.Fatalf("[%s] Unstable picks", kind)
+		}
+		shares := map[string]int{}
+		for _, endpoint := range before {
+			shares[endpoint]++
+		}
+		for endpoint, share := range shares {
+			if share < keys/10/2 || share > keys/10*2 {
+				t.Errorf("[%s] Unbalanced share for %s: %d", kind, endpoint, share)
+			}
+		}
+
+		// Adding an endpoint moves about 1/11 of the keys, mostly to it.
+		reg.Add("name", "v1", "addr10")
+		after := pickKeys(t, p, keys)
+		moved, elsewhere := 0, 0
+		for i := range before {
+			if before[i] != after[i] {
+				moved++
+				if after[i] != "addr10" {
+					elsewhere++
+				}
+			}
+		}
+		if moved < keys/11/2 || moved > keys/11*2 || elsewhere > keys/100 || (kind == "ring" && elsewhere != 0) {
+			t.Errorf("[%s] Unexpected remapping on add: %d moved, %d elsewhere", kind, moved, elsewhere)
+		}
+
+		// Removing it moves the keys back.
+		reg.DeleteEndpoint("name", "v1", "addr10")
+		if again := pickKeys(t, p, keys); !reflect.DeepEqual(before, again) {
+			t.Errorf("[%s] The keys should move back on removal", kind)
+		}
+
+		// Removing an endpoint only moves its keys, give or take.
+		reg.DeleteEndpoint("name", "v1", "addr3")
+		after = pickKeys(t, p, keys)
+		moved, elsewhere = 0, 0
+		for i := range before {
+			if before[i] != after[i] {
+				moved++
+				if before[i] != "addr3" {
+					elsewhere++
+				}
+			}
+			if after[i] == "addr3" {
+				t.Fatalf("[%s] Removed endpoint picked", kind)
+			}
+		}
+		if moved != shares["addr3"]+elsewhere || elsewhere > keys/100 || (kind == "ring" && elsewhere != 0) {
+			t.Errorf("[%s] Unexpected remapping on removal: %d moved, %d elsewhere", kind, moved, elsewhere)
+		}
+	}
+}
+
+func TestHashPickerConsistency(t *testing.T) {
+	for kind, newPicker := range hashPickers {
+		// Another client, with another insertion order and an incremental history, agrees.
+		reg1, reg2 := newTestRegistry(), newTestRegistry()
+		for i := 0; i < 5; i++ {
+			reg1.Add("name", "v1", "addr"+strconv.Itoa(i))
+			reg2.Add("name", "v1", "addr"+strconv.Itoa(9-i))
+		}
+		p1, p2 := newPicker(reg1, "name", "v1"), newPicker(reg2, "name", "v1")
+		_ = pickKeys(t, p2, 1)
+		for i := 5; i < 10; i++ {
+			reg1.Add("name", "v1", "addr"+strconv.Itoa(i))
+			reg2.Add("name", "v1", "addr"+strconv.Itoa(9-i))
+		}
+		if picks1, picks2 := pickKeys(t, p1, 1000), pickKeys(t, p2, 1000); !reflect.DeepEqual(picks1, picks2) {
+			t.Errorf("[%s] Inconsistent picks across clients", kind)
+		}
+
+		if _, err := newPicker(reg1, "unknown", "v1").Pick([]byte("key")); err != ErrServiceNotFound {
+			t.Errorf("[%s] Unexpected error.\nExpect:\t%v\nGot:\t%v", kind, ErrServiceNotFound, err)
+		}
+	}
+}
+
+func TestHashPickerWeights(t *testing.T) {
+	for kind, newPicker := range hashPickers {
+		reg := newTestRegistry()
+		reg.add("name", "v1", "addr1", Metadata{Weight: 3})
+		reg.add("name", "v1", "addr2", Metadata{Weight: 1})
+
+		shares := map[string]int{}
+		for _, endpoint := range pickKeys(t, newPicker(reg, "name", "v1"), 10000) {
+			shares[endpoint]++
+		}
+		// Expect ~75%/25%, allow some margin.
+		if shares["addr1"] < 6500 || shares["addr2"] < 1500 {
+			t.Errorf("[%s] Unexpected distribution: %v", kind, shares)
+		}
+	}
+}
+
+// Make sure the incremental ring updates match a full build.
+func TestRingTableUpdate(t *testing.T) {
+	incremental := &ringTable{}
+	incremental.update([]Instance{{Address: "addr1"}, {Address: "addr2"}, {Address: "addr3"}})
+	incremental.update([]Instance{{Address: "addr1"}, {Address: "addr3", Metadata: Metadata{Weight: 2}}, {Address: "addr4"}})
+
+	full := &ringTable{}
+	full.update([]Instance{{Address: "addr4"}, {Address: "addr3", Metadata: Metadata{Weight: 2}}, {Address: "addr1"}})
+	if !reflect.DeepEqual(full, incremental) {
+		t.Fatal("Incremental ring update differs from a full build")
+	}
+	if expect, got := 4*RingReplicas, len(full.points); expect != got {
+		t.Fatalf("Unexpected point count.\nExpect:\t%d\nGot:\t%d", expect, got)
+	}
+	// The weights are capped.
+	full.update([]Instance{{Address: "addr1", Metadata: Metadata{Weight: 1 << 30}}})
+	if expect, got := MaxHashWeight*RingReplicas, len(full.points); expect != got {
+		t.Fatalf("Unexpected point count.\nExpect:\t%d\nGot:\t%d", expect, got)
+	}
+}
+
+func TestHashPickerWatch(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	var registrations []*Registration
+	for i := 0; i < 3; i++ {
+		r, err := conn.Register("name", "v1", "addr"+strconv.Itoa(i))
+		if err != nil {
+			t.Fatalf("Error registering endpoint: %s", err)
+		}
+		registrations = append(registrations, r)
+	}
+	assertEventualLookup(t, conn.ZKRegistry, "name", "v1", []string{"addr0", "addr1", "addr2"}, nil)
+
+	p := conn.RingHashPicker("name", "v1")
+	before := pickKeys(t, p, 1000)
+	if err := registrations[0].Deregister(); err != nil {
+		t.Fatalf("Error deregistering endpoint: %s", err)
+	}
+	assertEventualLookup(t, conn.ZKRegistry, "name", "v1", []string{"addr1", "addr2"}, nil)
+	for i, endpoint := range pickKeys(t, p, 1000) {
+		if endpoint != before[i] && before[i] != "addr0" {
+			t.Fatalf("Key %d moved from %s to %s", i, before[i], endpoint)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package zkregistry
+
+import (
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// Health describes the state of the registry, i.e. for readiness probes.
+type Health struct {
+	State          string    `json:"state"`           // Zookeeper session state.
+	Connected      bool      `json:"connected"`       // Whether the zookeeper session is established.
+	Synced         bool      `json:"synced"`          // Whether the initial listing has been applied, see WaitSynced.
+	Stale          bool      `json:"stale"`           // Whether the watch is broken and the state may be outdated.
+	StaleSince     time.Time `json:"stale_since"`     // See StaleSince. Zero when not stale.
+	LastEvent      time.Time `json:"last_event"`      // Time of the last applied watcher event.
+	LastSync       time.Time `json:"last_sync"`       // Time of the last full sync with zookeeper.
+	Corrections    int64     `json:"corrections"`     // Changes applied by the reconciliation, catch-ups after a rewatch or a snapshot start included.
+	SuspectedDrops int64     `json:"suspected_drops"` // Watcher channel overflows, see Stats.
+	Error          string    `json:"error,omitempty"` // Why the registry is not started yet, see NewFederation.
+}
+
+// Ready returns true when the registry is connected, synced and up to date.
+func (h Health) Ready() bool {
+	return h.Connected && h.Synced && !h.Stale
+}
+
+// Health returns the current health of the registry.
+func (reg *ZKRegistry) Health() Health {
+	state := reg.conn.State()
+	h := Health{
+		State:     state.String(),
+		Connected: state == zk.StateHasSession,
+	}
+	select {
+	case <-reg.synced:
+		h.Synced = true
+	default:
+	}
+
+	reg.statsLock.Lock()
+	h.Stale = !reg.staleSince.IsZero()
+	h.StaleSince = reg.staleSince
+	h.LastEvent = reg.lastEvent
+	h.LastSync = reg.lastSync
+	h.Corrections = reg.stats.ReconcileAdded + reg.stats.ReconcileRemoved + reg.stats.ReconcileUpdated
+	h.SuspectedDrops = reg.stats.SuspectedDrops
+	reg.statsLock.Unlock()
+	return h
+}
+
+// touch records the time of the last applied event, or the last full sync.
+func (reg *ZKRegistry) touch(last *time.Time) {
+	reg.statsLock.Lock()
+	*last = time.Now()
+	reg.statsLock.Unlock()
+}
@@ -0,0 +1,90 @@
+package zkregistry
+
+import (
+	"context"
+	"errors"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/agrarianlabs/zkwatcher"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+func TestHealth(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := conn.WaitSynced(ctx); err != nil {
+		t.Fatalf("Error waiting for the registry to sync: %s", err)
+	}
+
+	h := conn.Health()
+	if !h.Ready() || !h.Connected || !h.Synced || h.Stale {
+		t.Fatalf("Registry should be ready: %+v", h)
+	}
+	if h.State != zk.StateHasSession.String() {
+		t.Fatalf("Unexpected state.\nExpect:\t%s\nGot:\t%s", zk.StateHasSession, h.State)
+	}
+	if h.LastSync.IsZero() {
+		t.Fatal("The initial sync time should be set")
+	}
+
+	// Applied events are tracked.
+	before := time.Now()
+	assertCreateTree(t, conn, "/discovery/name/version/addr")
+	time.Sleep(100 * time.Millisecond)
+	if h := conn.Health(); h.LastEvent.Before(before) {
+		t.Fatalf("The last event time should be updated: %s (before %s)", h.LastEvent, before)
+	}
+
+	// Missed events are counted once repaired.
+	conn.deleteEndpoint("name", "version", "addr")
+	if err := conn.reconcile(); err != nil {
+		t.Fatalf("Error reconciling the registry: %s", err)
+	}
+	if h := conn.Health(); h.Corrections != 1 || h.LastSync.Before(before) {
+		t.Fatalf("Unexpected health after reconciliation: %+v", h)
+	}
+
+	// A broken watch makes the registry stale.
+	conn.handleEvent(zkwatcher.Event{Path: path.Join(conn.root, "name"), Error: errors.New("fail")})
+	if h := conn.Health(); h.Ready() || !h.Stale || h.StaleSince.IsZero() {
+		t.Fatalf("Registry should be stale: %+v", h)
+	}
+}
+
+func TestHealthDisconnected(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	p := newTCPProxy(t, testZKHost)
+	p.Start()
+	defer p.Stop()
+	proxyConn, _, err := zk.Connect([]string{p.URL}, 1*time.Second)
+	if err != nil {
+		t.Fatalf("Unable to connect to ZK: %s", err)
+	}
+	defer proxyConn.Close()
+	proxyConn.SetLogger(discardLogger)
+
+	reg, err := New(proxyConn, path.Join(conn.prefix, "/test/discovery"), discardLogger)
+	if err != nil {
+		t.Fatalf("Error creating new registry: %s", err)
+	}
+	defer func() { _ = reg.Close() }() // Best effort.
+
+	p.Stop()
+	deadline := time.Now().Add(2 * time.Second)
+	for reg.Health().Connected {
+		if time.Now().After(deadline) {
+			t.Fatal("The registry should report the disconnection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if h := reg.Health(); h.Ready() {
+		t.Fatalf("A disconnected registry should not be ready: %+v", h)
+	}
+}
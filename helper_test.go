@@ -12,6 +12,8 @@ import (
 	"path"
 	"reflect"
 	"runtime"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 
@@ -56,12 +58,12 @@ type zkConn struct {
 	prefix string
 }
 
-// Close wraps zk.Conn.Close, removes the prefix
+// Close closes the registry, removes the prefix
 // and call zk.Conn.Close.
 func (c *zkConn) Close() {
+	_ = c.ZKRegistry.Close() // Best effort.
 	_ = removeTree(c.conn, c.prefix)
 	c.conn.Close()
-	_ = c.ZKRegistry.Close() // Best effort.
 }
 
 func zkConnect(t *testing.T) *zkConn {
@@ -102,7 +104,7 @@ func assertZKPathExist(t *testing.T, conn *zkConn, zkPath string) {
 // assertCreateTree prefix the given zkPath and creates the nodes.
 func assertCreateTree(t *testing.T, conn *zkConn, zkPath string) {
 	file, line := getCaller(t, 1)
-	if err := createTree(conn.conn, path.Join(conn.prefix, zkPath)); err != nil {
+	if err := createTree(conn.conn, path.Join(conn.prefix, zkPath), zk.WorldACL(zk.PermAll)); err != nil {
 		t.Fatalf("[%s:%d] Error creating %q: %s", file, line, zkPath, err)
 	}
 }
@@ -125,11 +127,34 @@ func assertLookupResult(t *testing.T, conn *zkConn, svcName, svcVersion string,
 	}
 }
 
+// assertEventualLookup waits for the registry to return the expected endpoints, in any order.
+func assertEventualLookup(t *testing.T, reg *ZKRegistry, svcName, svcVersion string, expect []string, expectErr error) {
+	file, line := getCaller(t, 1)
+	sort.Strings(expect)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got, err := reg.Lookup(svcName, svcVersion)
+		sorted := append([]string(nil), got...)
+		sort.Strings(sorted)
+		if err == expectErr && (err != nil || reflect.DeepEqual(expect, sorted) || len(expect)+len(sorted) == 0) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("[%s:%d] Unexpected lookup result for %s/%s.\nExpect:\t%v (%v)\nGot:\t%v (%v)",
+				file, line, svcName, svcVersion, expect, expectErr, got, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 type tcpProxy struct {
 	t          *testing.T
 	targetAddr string
 	ln         net.Listener
 	URL        string
+
+	lock  sync.Mutex
+	conns []net.Conn // Active connections, closed on Stop.
 }
 
 func newTCPProxy(t *testing.T, targetAddr string) *tcpProxy {
@@ -139,8 +164,13 @@ func newTCPProxy(t *testing.T, targetAddr string) *tcpProxy {
 	}
 }
 
+// Start listens for connections. When restarted, the same address is used.
 func (p *tcpProxy) Start() {
-	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	addr := "127.0.0.1:0"
+	if p.URL != "" {
+		addr = p.URL
+	}
+	ln, err := net.Listen("tcp", addr)
 	if err != nil {
 		p.t.Fatal(err)
 	}
@@ -158,14 +188,25 @@ func (p *tcpProxy) Start() {
 				// Discard dial errors. Let the caller check for issues.
 				return
 			}
+			p.lock.Lock()
+			p.conns = append(p.conns, connClient, connServer)
+			p.lock.Unlock()
 			go func() { defer func() { _ = connServer.Close() }(); _, _ = io.Copy(connServer, connClient) }()
 			go func() { _, _ = io.Copy(connClient, connServer) }()
 		}
 	}()
 }
 
+// Stop stops listening and cuts the active connections.
 func (p *tcpProxy) Stop() {
 	_ = p.ln.Close() // Best effort.
+
+	p.lock.Lock()
+	for _, conn := range p.conns {
+		_ = conn.Close() // Best effort.
+	}
+	p.conns = nil
+	p.lock.Unlock()
 }
 
 func getCaller(t testing.TB, offset int) (file string, line int) {
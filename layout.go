@@ -0,0 +1,248 @@
+package zkregistry
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// Layout maps the zookeeper tree of a registry to the service name/version/endpoint catalog.
+// The instance nodes are the deepest ones, the nodes above only group them.
+// i.e. an environment/region/service/version/endpoint hierarchy has a depth of 5 and
+// folds the environment and the region into the service name.
+type Layout interface {
+	// Depth returns the number of levels below the registry root, the instance nodes being the deepest.
+	Depth() int
+	// Parse returns the key of the node at the given path elements, relative to the registry root.
+	// The key of a parent node is partial, empty above the service level, and the endpoint
+	// of an instance node is its node name.
+	Parse(elems []string) (Key, error)
+	// Decode returns the endpoints published by the given instance node.
+	// Entries may be returned along with an error for partially invalid data.
+	Decode(key Key, data []byte) ([]Entry, error)
+	// Node returns the path elements of a new instance node for the given endpoint, see Register.
+	Node(key Key) ([]string, error)
+	// Encode returns the data of the given instance node for the given endpoint.
+	Encode(key Key, node string, meta Metadata) ([]byte, error)
+	// Flags returns the zookeeper flags of the instance nodes, in addition to zk.FlagEphemeral.
+	Flags() int32
+}
+
+// Key identifies a node of the registry tree, see Layout.
+type Key struct {
+	Name     string
+	Version  string
+	Endpoint string
+}
+
+// Entry is an endpoint published by an instance node, see Layout.
+type Entry struct {
+	Key      Key
+	Metadata Metadata
+}
+
+// Builtin layouts.
+var (
+	// DefaultLayout is the /<name>/<version>/<endpoint> layout with the metadata as JSON node data.
+	DefaultLayout Layout = defaultLayout{}
+	// CuratorLayout is the Apache Curator x-discovery layout, see WithCuratorLayout.
+	CuratorLayout Layout = curatorLayout{}
+	// ServersetLayout is the Finagle/Aurora serverset layout, see WithServersetLayout.
+	ServersetLayout Layout = serversetLayout{}
+)
+
+// defaultLayout is the /<name>/<version>/<endpoint> layout with the metadata as JSON node data.
+type defaultLayout struct{}
+
+func (defaultLayout) Depth() int { return 3 }
+
+// Parse goes through ParseConfigPath, see ZKRegistry.parse for the registry tree.
+func (defaultLayout) Parse(elems []string) (Key, error) {
+	name, version, endpoint, err := ParseConfigPath(strings.Join(elems, "/"), 0)
+	return Key{Name: name, Version: version, Endpoint: endpoint}, err
+}
+
+func (defaultLayout) Decode(key Key, data []byte) ([]Entry, error) {
+	// Invalid data yields empty metadata.
+	meta, err := parseMetadata(data)
+	return []Entry{{Key: key, Metadata: meta}}, err
+}
+
+func (defaultLayout) Node(key Key) ([]string, error) {
+	return []string{key.Name, key.Version, key.Endpoint}, nil
+}
+
+func (defaultLayout) Encode(key Key, node string, meta Metadata) ([]byte, error) {
+	return encodeMetadata(meta)
+}
+
+func (defaultLayout) Flags() int32 { return 0 }
+
+// parse returns the key of the node at the given path elements, relative to the registry root.
+// The default layout goes through ParseConfigPath with the full zookeeper path and the root offset,
+// so overriding ParseConfigPath keeps working.
+func (reg *ZKRegistry) parse(elems []string) (Key, error) {
+	if _, ok := reg.layout.(defaultLayout); !ok {
+		return reg.layout.Parse(elems)
+	}
+	name, version, endpoint, err := ParseConfigPath(reg.nodePath(elems), reg.offset)
+	return Key{Name: name, Version: version, Endpoint: endpoint}, err
+}
+
+// relative returns the path elements of the given zookeeper path below the registry root.
+func (reg *ZKRegistry) relative(zkPath string) ([]string, error) {
+	zkPath = sanitizePath(zkPath)
+	parts := strings.Split(zkPath, "/")
+	if len(parts) < int(reg.offset) {
+		return nil, fmt.Errorf("invalid path received: %q", zkPath)
+	}
+	return parts[reg.offset:], nil
+}
+
+// readNode fetches and decodes the given instance node.
+// Returns false if the node does not exist anymore, and an error if it can't be read.
+// Undecodable data is decoded as empty.
+func (reg *ZKRegistry) readNode(zkPath string, key Key) ([]Entry, bool, error) {
+	data, _, err := reg.conn.Get(zkPath)
+	if err == zk.ErrNoNode {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, fmt.Errorf("error reading endpoint data %q: %s", zkPath, err)
+	}
+	entries, err := reg.layout.Decode(key, data)
+	if err != nil {
+		reg.logger.Printf("error parsing endpoint data %q: %s", zkPath, err)
+	}
+	return entries, true, nil
+}
+
+// refreshNode reads and applies the given instance node.
+// On read error, the last known endpoints of the node are kept, the reconciliation retries.
+// NOTE: expected to be called from the watcher goroutine.
+func (reg *ZKRegistry) refreshNode(zkPath string, key Key) {
+	entries, ok, err := reg.readNode(zkPath, key)
+	if err != nil {
+		reg.logger.Printf("%s, keeping the last known endpoints", err)
+		return
+	}
+	if ok {
+		reg.applyNode(zkPath, entries)
+	}
+}
+
+// applyNode sets the endpoints published by the given instance node.
+// The endpoints the node does not publish anymore are removed.
+// NOTE: expected to be called from the watcher goroutine.
+func (reg *ZKRegistry) applyNode(zkPath string, entries []Entry) {
+	previous := reg.nodes[zkPath]
+	reg.nodes[zkPath] = entries
+	for _, old := range previous {
+		if !hasEntry(entries, old.Key) {
+			reg.dropEntry(zkPath, old.Key)
+		}
+	}
+	for _, e := range entries {
+		reg.clearLocal(e.Key.Name, e.Key.Version, e.Key.Endpoint)
+		reg.add(e.Key.Name, e.Key.Version, e.Key.Endpoint, e.Metadata)
+	}
+}
+
+// removeNode removes the endpoints published by the given instance node.
+// NOTE: expected to be called from the watcher goroutine.
+func (reg *ZKRegistry) removeNode(zkPath string) {
+	entries, ok := reg.nodes[zkPath]
+	if !ok {
+		return
+	}
+	delete(reg.nodes, zkPath)
+	for _, e := range entries {
+		reg.dropEntry(zkPath, e.Key)
+	}
+}
+
+// removeParent removes the given parent node along with the instance nodes below it.
+// NOTE: expected to be called from the watcher goroutine.
+func (reg *ZKRegistry) removeParent(zkPath string, key Key) {
+	for node := range reg.nodes {
+		if strings.HasPrefix(node, zkPath+"/") {
+			reg.removeNode(node)
+		}
+	}
+	if key.Version != "" {
+		reg.DeleteVersion(key.Name, key.Version)
+	} else if key.Name != "" {
+		reg.DeleteService(key.Name)
+		reg.setAliases(key.Name, nil)
+		reg.setSplit(key.Name, nil)
+	}
+}
+
+// dropEntry removes the given endpoint of the given instance node, unless another instance node still publishes it.
+func (reg *ZKRegistry) dropEntry(zkPath string, key Key) {
+	reg.clearLocal(key.Name, key.Version, key.Endpoint)
+	for _, entries := range reg.nodes {
+		for _, e := range entries {
+			if e.Key == key {
+				reg.add(key.Name, key.Version, key.Endpoint, e.Metadata)
+				return
+			}
+		}
+	}
+	reg.deleteEndpoint(key.Name, key.Version, key.Endpoint)
+
+	// Versions not backed by a parent node go away with their last endpoint, as on reconciliation.
+	if list, ok := reg.catalog().lookup(key.Name, key.Version); ok && len(list.endpoints) == 0 {
+		elems, err := reg.relative(path.Dir(zkPath))
+		if err != nil {
+			return
+		}
+		if parent, err := reg.parse(elems); err == nil && (parent.Version == "" || parent.Version != key.Version) {
+			reg.DeleteVersion(key.Name, key.Version)
+		}
+	}
+}
+
+// hasEntry checks if the given entries publish the given endpoint.
+func hasEntry(entries []Entry, key Key) bool {
+	for _, e := range entries {
+		if e.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// walkTree lists the nodes below the given root down to the given depth, parents first.
+// Each node is returned as its path elements relative to the root.
+// Nodes removed during the walk are skipped.
+func walkTree(conn *zk.Conn, root string, depth int) ([][]string, error) {
+	var nodes [][]string
+	level := [][]string{{}}
+	for i := 0; i < depth; i++ {
+		var next [][]string
+		for _, parent := range level {
+			zkPath := path.Join(append([]string{root}, parent...)...)
+			children, _, err := conn.Children(zkPath)
+			if err == zk.ErrNoNode && i > 0 {
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("error listing %q: %s", zkPath, err)
+			}
+			for _, child := range children {
+				elems := make([]string, len(parent), len(parent)+1)
+				copy(elems, parent)
+				next = append(next, append(elems, child))
+			}
+		}
+		nodes = append(nodes, next...)
+		level = next
+	}
+	return nodes, nil
+}
+
+// nodePath returns the zookeeper path of the given node path elements.
+func (reg *ZKRegistry) nodePath(elems []string) string {
+	return path.Join(append([]string{reg.root}, elems...)...)
+}
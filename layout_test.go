@@ -0,0 +1,212 @@
+package zkregistry
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+func TestDefaultLayout(t *testing.T) {
+	l := defaultLayout{}
+	for elems, expect := range map[string]Key{
+		"":                     {},
+		"name":                 {Name: "name"},
+		"name/version":         {Name: "name", Version: "version"},
+		"name/version/addr:80": {Name: "name", Version: "version", Endpoint: "addr:80"},
+	} {
+		var parts []string
+		if elems != "" {
+			parts = strings.Split(elems, "/")
+		}
+		if got, err := l.Parse(parts); err != nil || expect != got {
+			t.Errorf("[%s] Unexpected key.\nExpect:\t%+v\nGot:\t%+v (%v)", elems, expect, got, err)
+		}
+	}
+	if _, err := l.Parse([]string{"name", "version", "addr", "extra"}); err == nil {
+		t.Error("Paths deeper than the layout should fail")
+	}
+
+	// The registry hands the full path and the root offset to ParseConfigPath, as before Layout.
+	defer func(parse func(string, uint) (string, string, string, error)) { ParseConfigPath = parse }(ParseConfigPath)
+	var gotPath string
+	var gotOffset uint
+	ParseConfigPath = func(zkPath string, offset uint) (string, string, string, error) {
+		gotPath, gotOffset = zkPath, offset
+		return parseConfigPath(zkPath, offset)
+	}
+	reg := &ZKRegistry{root: "/prefix/discovery", offset: 2, layout: DefaultLayout}
+	if got, err := reg.parse([]string{"name", "version"}); err != nil || got != (Key{Name: "name", Version: "version"}) {
+		t.Fatalf("Unexpected key: %+v (%v)", got, err)
+	}
+	if gotPath != "/prefix/discovery/name/version" || gotOffset != 2 {
+		t.Fatalf("Unexpected ParseConfigPath call: %q, %d", gotPath, gotOffset)
+	}
+
+	key := Key{Name: "name", Version: "version", Endpoint: "addr"}
+	if elems, err := l.Node(key); err != nil || !reflect.DeepEqual([]string{"name", "version", "addr"}, elems) {
+		t.Fatalf("Unexpected node: %v (%v)", elems, err)
+	}
+	meta := Metadata{Zone: "a"}
+	data, err := l.Encode(key, "addr", meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := l.Decode(key, data); err != nil || !reflect.DeepEqual([]Entry{{Key: key, Metadata: meta}}, got) {
+		t.Fatalf("Unexpected entries: %v (%v)", got, err)
+	}
+	// Invalid data yields empty metadata.
+	if got, err := l.Decode(key, []byte("invalid")); err == nil || !reflect.DeepEqual([]Entry{{Key: key}}, got) {
+		t.Fatalf("Unexpected entries: %v (%v)", got, err)
+	}
+}
+
+func TestWalkTree(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	assertCreateTree(t, conn, "/test/a/1/x")
+	assertCreateTree(t, conn, "/test/a/2")
+	assertCreateTree(t, conn, "/test/b")
+
+	nodes, err := walkTree(conn.conn, path.Join(conn.prefix, "/test"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, elems := range nodes {
+		got = append(got, strings.Join(elems, "/"))
+	}
+	// Parents first, the order of the siblings is up to zookeeper.
+	sort.Strings(got[:2])
+	sort.Strings(got[2:])
+	if expect := []string{"a", "b", "a/1", "a/2"}; !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected nodes.\nExpect:\t%v\nGot:\t%v", expect, got)
+	}
+
+	if _, err := walkTree(conn.conn, path.Join(conn.prefix, "/missing"), 2); err == nil {
+		t.Fatal("Walking a missing root should fail")
+	}
+}
+
+// Make sure an endpoint published by several instance nodes stays until the last one goes away.
+func TestLayoutSharedEndpoint(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	reg, err := New(conn.conn, path.Join(conn.prefix, "/curator"), discardLogger, WithCuratorLayout())
+	if err != nil {
+		t.Fatalf("Error creating the registry: %s", err)
+	}
+	defer func() { _ = reg.Close() }() // Best effort.
+
+	assertCreateTree(t, conn, "/curator/name")
+	first := path.Join(conn.prefix, "/curator/name/first")
+	second := path.Join(conn.prefix, "/curator/name/second")
+	for _, zkPath := range []string{first, second} {
+		if _, err := conn.conn.Create(zkPath, []byte(jvmInstance), 0, zk.WorldACL(zk.PermAll)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertEventualLookup(t, reg, "name", "", []string{"10.0.0.1:8080"}, nil)
+
+	if err := conn.conn.Delete(first, -1); err != nil {
+		t.Fatal(err)
+	}
+	assertEventualLookup(t, reg, "name", "", []string{"10.0.0.1:8080"}, nil)
+
+	if err := conn.conn.Delete(second, -1); err != nil {
+		t.Fatal(err)
+	}
+	assertEventualLookup(t, reg, "name", "", nil, ErrServiceNotFound)
+}
+
+// regionLayout is an /<env>/<region>/<service>/<version>/<endpoint> layout,
+// listing the services as <env>.<region>.<service>.
+type regionLayout struct{ defaultLayout }
+
+func (regionLayout) Depth() int { return 5 }
+
+func (regionLayout) Parse(elems []string) (Key, error) {
+	switch {
+	case len(elems) > 5:
+		return Key{}, fmt.Errorf("invalid path: %q", elems)
+	case len(elems) < 3:
+		return Key{}, nil
+	}
+	key := Key{Name: strings.Join(elems[:3], ".")}
+	if len(elems) > 3 {
+		key.Version = elems[3]
+	}
+	if len(elems) > 4 {
+		key.Endpoint = elems[4]
+	}
+	return key, nil
+}
+
+func (regionLayout) Node(key Key) ([]string, error) {
+	parts := strings.Split(key.Name, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid service name: %q", key.Name)
+	}
+	return append(parts, key.Version, key.Endpoint), nil
+}
+
+func TestCustomLayout(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	root := path.Join(conn.prefix, "/regions")
+	reg, err := New(conn.conn, root, discardLogger, WithLayout(regionLayout{}))
+	if err != nil {
+		t.Fatalf("Error creating the registry: %s", err)
+	}
+	defer func() { _ = reg.Close() }() // Best effort.
+
+	r, err := reg.RegisterInstance("prod.us-east.name", "v1", Instance{Address: "addr", Metadata: Metadata{Zone: "a"}})
+	if err != nil {
+		t.Fatalf("Error registering endpoint: %s", err)
+	}
+	assertZKPathExist(t, conn, path.Join(root, "prod/us-east/name/v1/addr"))
+	assertEventualLookup(t, reg, "prod.us-east.name", "v1", []string{"addr"}, nil)
+	if instances, err := reg.LookupInstances("prod.us-east.name", "v1"); err != nil || len(instances) != 1 || instances[0].Metadata.Zone != "a" {
+		t.Fatalf("Unexpected instances: %v (%v)", instances, err)
+	}
+
+	// Nodes created by others.
+	assertCreateTree(t, conn, "/regions/staging/eu-west/name/v2/other")
+	assertEventualLookup(t, reg, "staging.eu-west.name", "v2", []string{"other"}, nil)
+
+	if _, err := reg.Register("name", "v1", "addr"); err == nil {
+		t.Fatal("Names the layout can't map should fail")
+	}
+
+	if err := r.Deregister(); err != nil {
+		t.Fatalf("Error deregistering endpoint: %s", err)
+	}
+	assertEventualLookup(t, reg, "prod.us-east.name", "v1", nil, nil)
+
+	// Removing a level above the service drops the services below it.
+	assertRemoveTree(t, conn, "/regions/staging")
+	assertEventualLookup(t, reg, "staging.eu-west.name", "v2", nil, ErrServiceNotFound)
+}
+
+// invalidLayout has no instance level.
+type invalidLayout struct{ defaultLayout }
+
+func (invalidLayout) Depth() int { return 0 }
+
+func TestInvalidLayout(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	for _, layout := range []Layout{nil, invalidLayout{}} {
+		if _, err := New(conn.conn, path.Join(conn.prefix, "/test"), discardLogger, WithLayout(layout)); err != ErrInvalidLayout {
+			t.Errorf("Unexpected error.\nExpect:\t%v\nGot:\t%v", ErrInvalidLayout, err)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package zkregistry
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// Locality is the region/zone of an endpoint or of the registry client.
+type Locality struct {
+	Region string
+	Zone   string
+}
+
+// LocalityRouting configures the locality-aware lookups, see LookupLocal.
+type LocalityRouting struct {
+	Locality                              // Local region/zone of the client.
+	MinHealthy        int                 // Healthy endpoints needed in a locality before spilling over. <= 0 means 1.
+	MinHealthyPercent int                 // Percentage of the endpoints of a locality needed healthy before spilling over.
+	CIDRs             map[string]Locality // Locality of the endpoints without one in their metadata, by network of their host.
+}
+
+// cidrLocality is a parsed entry of LocalityRouting.CIDRs.
+type cidrLocality struct {
+	network  *net.IPNet
+	locality Locality
+}
+
+// parseCIDRs parses the given CIDR->locality table, the most specific networks first.
+func parseCIDRs(table map[string]Locality) ([]cidrLocality, error) {
+	ret := make([]cidrLocality, 0, len(table))
+	for cidr, locality := range table {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid locality network %q: %s", cidr, err)
+		}
+		ret = append(ret, cidrLocality{network: network, locality: locality})
+	}
+	sort.Sort(byPrefixLen(ret))
+	return ret, nil
+}
+
+// byPrefixLen sorts the networks from the most specific one, then by address for a stable order.
+type byPrefixLen []cidrLocality
+
+func (s byPrefixLen) Len() int      { return len(s) }
+func (s byPrefixLen) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byPrefixLen) Less(i, j int) bool {
+	li, _ := s[i].network.Mask.Size()
+	lj, _ := s[j].network.Mask.Size()
+	if li != lj {
+		return li > lj
+	}
+	return s[i].network.String() < s[j].network.String()
+}
+
+// instanceLocality returns the locality of the given instance: from its metadata,
+// the missing parts coming from the network of its host, see LocalityRouting.CIDRs.
+func (reg *ZKRegistry) instanceLocality(instance Instance) Locality {
+	locality := Locality{Region: instance.Metadata.Region, Zone: instance.Metadata.Zone}
+	if (locality.Region != "" && locality.Zone != "") || len(reg.cidrs) == 0 {
+		return locality
+	}
+	host, _, err := net.SplitHostPort(instance.Address)
+	if err != nil {
+		host = instance.Address // No port.
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return locality
+	}
+	for _, c := range reg.cidrs {
+		if !c.network.Contains(ip) {
+			continue
+		}
+		if locality.Region == "" {
+			locality.Region = c.locality.Region
+		}
+		if locality.Zone == "" {
+			locality.Zone = c.locality.Zone
+		}
+		break
+	}
+	return locality
+}
+
+// localityTier is the proximity of an endpoint to the client.
+type localityTier int
+
+// localityTier enum values, the closest first.
+const (
+	tierZone localityTier = iota
+	tierRegion
+	tierGlobal
+)
+
+// tier returns the proximity of the given endpoint locality to the local one.
+// Endpoints without region are considered in the local one when in the local zone.
+func (cfg LocalityRouting) tier(locality Locality) localityTier {
+	sameRegion := cfg.Region != "" && locality.Region == cfg.Region
+	if cfg.Zone != "" && locality.Zone == cfg.Zone && (sameRegion || cfg.Region == "" || locality.Region == "") {
+		return tierZone
+	}
+	if sameRegion {
+		return tierRegion
+	}
+	return tierGlobal
+}
+
+// healthy checks if the given healthy/total endpoints of a locality are enough to serve it.
+func (cfg LocalityRouting) healthy(healthy, total int) bool {
+	min := cfg.MinHealthy
+	if min <= 0 {
+		min = 1
+	}
+	return healthy >= min && healthy*100 >= cfg.MinHealthyPercent*total
+}
+
+// filterLocal returns the endpoints of the closest locality with enough healthy endpoints:
+// the local zone, then the local region, then everything.
+// Ejected endpoints are excluded, see filterEjected.
+// NOTE: does not lock nor modify the given list.
+func (reg *ZKRegistry) filterLocal(name, version string, list *endpointList) *endpointList {
+	cfg := reg.locality
+	if cfg.Zone == "" && cfg.Region == "" {
+		return reg.filterEjected(name, version, list)
+	}
+
+	ejected := reg.ejected.Load().(map[endpointKey]time.Time)
+	now := time.Now()
+
+	var total, healthy [tierGlobal][]Instance
+	for _, instance := range list.instances {
+		tier := cfg.tier(reg.instanceLocality(instance))
+		// The local zone is part of the local region.
+		for t := tier; t < tierGlobal; t++ {
+			total[t] = append(total[t], instance)
+			until, ok := ejected[endpointKey{name: name, version: version, endpoint: instance.Address}]
+			if !ok || !now.Before(until) {
+				healthy[t] = append(healthy[t], instance)
+			}
+		}
+	}
+	for t := tierZone; t < tierGlobal; t++ {
+		if cfg.healthy(len(healthy[t]), len(total[t])) {
+			return newEndpointList(healthy[t])
+		}
+	}
+	return reg.filterEjected(name, version, list)
+}
+
+// LookupLocal returns the endpoint list for the given service name/version, restricted to the closest locality:
+// the endpoints of the local zone if enough of them are healthy, otherwise the ones of the local region,
+// otherwise all of them, see WithLocalityRouting.
+// As for Lookup, ejected endpoints are excluded and the returned slice must not be modified.
+func (reg *ZKRegistry) LookupLocal(name, version string) ([]string, error) {
+	current := reg.catalog()
+	version = current.resolve(name, version)
+	list, ok := current.lookup(name, version)
+	if !ok {
+		return nil, ErrServiceNotFound
+	}
+	return reg.filterLocal(name, version, list).endpoints, nil
+}
+
+// LookupInstancesLocal returns the endpoint list along with their metadata for the given service name/version,
+// restricted to the closest locality, see LookupLocal.
+func (reg *ZKRegistry) LookupInstancesLocal(name, version string) ([]Instance, error) {
+	current := reg.catalog()
+	version = current.resolve(name, version)
+	list, ok := current.lookup(name, version)
+	if !ok {
+		return nil, ErrServiceNotFound
+	}
+	return reg.filterLocal(name, version, list).instances, nil
+}
@@ -0,0 +1,159 @@
+package zkregistry
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInstanceLocality(t *testing.T) {
+	cidrs, err := parseCIDRs(map[string]Locality{
+		"10.0.0.0/16":  {Region: "us-east"},
+		"10.0.1.0/24":  {Region: "us-east", Zone: "us-east-1a"},
+		"fd00::/64":    {Region: "eu-west", Zone: "eu-west-1b"},
+		"10.0.0.0/8":   {Region: "other", Zone: "other"},
+		"10.0.1.64/26": {Region: "us-east", Zone: "us-east-1c"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := newTestRegistry()
+	reg.cidrs = cidrs
+
+	for _, elem := range []struct {
+		instance Instance
+		expect   Locality
+	}{
+		{Instance{Address: "10.0.1.2:80"}, Locality{Region: "us-east", Zone: "us-east-1a"}},
+		{Instance{Address: "10.0.1.65:80"}, Locality{Region: "us-east", Zone: "us-east-1c"}},
+		{Instance{Address: "10.0.9.1"}, Locality{Region: "us-east"}},
+		{Instance{Address: "10.9.9.9:80"}, Locality{Region: "other", Zone: "other"}},
+		{Instance{Address: "[fd00::1]:80"}, Locality{Region: "eu-west", Zone: "eu-west-1b"}},
+		{Instance{Address: "192.168.0.1:80"}, Locality{}},
+		{Instance{Address: "host:80"}, Locality{}},
+		// The metadata takes precedence.
+		{Instance{Address: "10.0.1.2:80", Metadata: Metadata{Region: "r", Zone: "z"}}, Locality{Region: "r", Zone: "z"}},
+		{Instance{Address: "10.0.1.2:80", Metadata: Metadata{Zone: "z"}}, Locality{Region: "us-east", Zone: "z"}},
+		{Instance{Address: "host:80", Metadata: Metadata{Zone: "z"}}, Locality{Zone: "z"}},
+	} {
+		if got := reg.instanceLocality(elem.instance); elem.expect != got {
+			t.Errorf("[%s] Unexpected locality.\nExpect:\t%+v\nGot:\t%+v", elem.instance.Address, elem.expect, got)
+		}
+	}
+
+	if _, err := parseCIDRs(map[string]Locality{"10.0.0.0": {Zone: "a"}}); err == nil {
+		t.Fatal("Invalid network should fail")
+	}
+}
+
+// assertLocalLookup checks the result of LookupLocal.
+func assertLocalLookup(t *testing.T, reg *ZKRegistry, expect []string) {
+	file, line := getCaller(t, 1)
+	if got, err := reg.LookupLocal("name", "v1"); err != nil {
+		t.Fatalf("[%s:%d] Error looking up local endpoints: %s", file, line, err)
+	} else if !reflect.DeepEqual(expect, got) {
+		t.Fatalf("[%s:%d] Unexpected endpoints.\nExpect:\t%v\nGot:\t%v", file, line, expect, got)
+	}
+}
+
+func TestLookupLocal(t *testing.T) {
+	reg := newTestRegistry()
+	reg.logger = discardLogger
+	reg.SetOutlierDetection(OutlierDetection{ConsecutiveFailures: 1, BaseEjectionTime: time.Minute, MaxEjectionPercent: 100})
+
+	reg.add("name", "v1", "10.0.1.1:80", Metadata{Region: "us-east", Zone: "us-east-1a"})
+	reg.add("name", "v1", "10.0.1.2:80", Metadata{})
+	reg.add("name", "v1", "10.0.2.1:80", Metadata{Region: "us-east", Zone: "us-east-1b"})
+	reg.add("name", "v1", "10.0.9.1:80", Metadata{})
+	reg.add("name", "v1", "10.1.0.1:80", Metadata{Region: "eu-west", Zone: "eu-west-1a"})
+	all := []string{"10.0.1.1:80", "10.0.1.2:80", "10.0.2.1:80", "10.0.9.1:80", "10.1.0.1:80"}
+
+	// Without locality, everything.
+	assertLocalLookup(t, reg, all)
+
+	reg.locality = LocalityRouting{
+		Locality:   Locality{Region: "us-east", Zone: "us-east-1a"},
+		MinHealthy: 2,
+	}
+	cidrs, err := parseCIDRs(map[string]Locality{
+		"10.0.0.0/16": {Region: "us-east"},
+		"10.0.1.0/24": {Region: "us-east", Zone: "us-east-1a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.cidrs = cidrs
+	assertLocalLookup(t, reg, []string{"10.0.1.1:80", "10.0.1.2:80"})
+	if _, err := reg.LookupLocal("name", "v2"); err != ErrServiceNotFound {
+		t.Fatalf("Unexpected error.\nExpect:\t%v\nGot:\t%v", ErrServiceNotFound, err)
+	}
+
+	// Spill over to the region, then globally.
+	errFailure := errors.New("failure")
+	reg.Failure("name", "v1", "10.0.1.1:80", errFailure)
+	assertLocalLookup(t, reg, []string{"10.0.1.2:80", "10.0.2.1:80", "10.0.9.1:80"})
+	reg.Failure("name", "v1", "10.0.2.1:80", errFailure)
+	reg.Failure("name", "v1", "10.0.9.1:80", errFailure)
+	assertLocalLookup(t, reg, []string{"10.0.1.2:80", "10.1.0.1:80"})
+
+	// Percentage threshold.
+	reg.Success("name", "v1", "10.0.2.1:80")
+	reg.Success("name", "v1", "10.0.9.1:80")
+	reg.locality.MinHealthy = 1
+	assertLocalLookup(t, reg, []string{"10.0.1.2:80"})
+	reg.locality.MinHealthyPercent = 75
+	assertLocalLookup(t, reg, []string{"10.0.1.2:80", "10.0.2.1:80", "10.0.9.1:80"})
+	reg.locality.MinHealthyPercent = 90
+	assertLocalLookup(t, reg, []string{"10.0.1.2:80", "10.0.2.1:80", "10.0.9.1:80", "10.1.0.1:80"})
+
+	// Everything ejected in the panic mode.
+	for _, endpoint := range all {
+		reg.Failure("name", "v1", endpoint, errFailure)
+	}
+	assertLocalLookup(t, reg, all)
+
+	// The local picker follows.
+	reg.Success("name", "v1", "10.0.1.1:80")
+	reg.locality.MinHealthyPercent = 0
+	p := reg.LocalPicker("name", "v1", RoundRobin)
+	for i := 0; i < 10; i++ {
+		if got, err := p.Next(); err != nil || got != "10.0.1.1:80" {
+			t.Fatalf("[%d] Unexpected endpoint: %s (%v)", i, got, err)
+		}
+	}
+}
+
+func TestLocalityRouting(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	if _, err := New(conn.conn, conn.prefix+"discovery", discardLogger, WithLocalityRouting(LocalityRouting{CIDRs: map[string]Locality{"invalid": {Zone: "a"}}})); err == nil {
+		t.Fatal("Invalid locality network should fail")
+	}
+
+	reg, err := New(conn.conn, conn.prefix+"discovery", discardLogger, WithLocalityRouting(LocalityRouting{
+		Locality: Locality{Region: "us-east", Zone: "us-east-1a"},
+		CIDRs:    map[string]Locality{"10.0.1.0/24": {Region: "us-east", Zone: "us-east-1a"}},
+	}))
+	if err != nil {
+		t.Fatalf("Error creating the registry: %s", err)
+	}
+	defer func() { _ = reg.Close() }() // Best effort.
+
+	for _, instance := range []Instance{
+		{Address: "10.0.1.1:80"},
+		{Address: "10.0.2.1:80", Metadata: Metadata{Region: "us-east", Zone: "us-east-1b"}},
+	} {
+		if _, err := reg.RegisterInstance("name", "v1", instance); err != nil {
+			t.Fatalf("Error registering endpoint: %s", err)
+		}
+	}
+	assertEventualLookup(t, reg, "name", "v1", []string{"10.0.1.1:80", "10.0.2.1:80"}, nil)
+	if got, err := reg.LookupInstancesLocal("name", "v1"); err != nil || len(got) != 1 || got[0].Address != "10.0.1.1:80" {
+		t.Fatalf("Unexpected local instances: %v (%v)", got, err)
+	}
+	if got, err := reg.LookupInstances("name", "v1"); err != nil || len(got) != 2 || got[1].Metadata.Region != "us-east" {
+		t.Fatalf("Unexpected instances: %v (%v)", got, err)
+	}
+}
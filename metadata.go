@@ -0,0 +1,40 @@
+package zkregistry
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Metadata is the JSON payload stored in the endpoint nodes.
+type Metadata struct {
+	Weight   int      `json:"weight,omitempty"`    // Relative weight of the endpoint. <= 0 means default.
+	Region   string   `json:"region,omitempty"`    // Region of the endpoint.
+	Zone     string   `json:"zone,omitempty"`      // Availability zone of the endpoint.
+	Tags     []string `json:"tags,omitempty"`      // Free form tags.
+	Protocol string   `json:"protocol,omitempty"`  // Protocol spoken by the endpoint (http, grpc, etc).
+	BuildSHA string   `json:"build_sha,omitempty"` // Build revision of the endpoint.
+}
+
+// Instance is an endpoint with its metadata.
+type Instance struct {
+	Address  string   `json:"address"`
+	Metadata Metadata `json:"metadata"`
+}
+
+// parseMetadata decodes the given endpoint node data.
+// Empty data yields empty metadata.
+func parseMetadata(data []byte) (Metadata, error) {
+	var meta Metadata
+	if len(data) == 0 {
+		return meta, nil
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return Metadata{}, fmt.Errorf("invalid endpoint metadata: %s", err)
+	}
+	return meta, nil
+}
+
+// encodeMetadata encodes the given metadata for an endpoint node.
+func encodeMetadata(meta Metadata) ([]byte, error) {
+	return json.Marshal(meta)
+}
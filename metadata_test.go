@@ -0,0 +1,46 @@
+package zkregistry
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMetadata(t *testing.T) {
+	for _, elem := range []struct {
+		data   string   // Input.
+		expect Metadata // Expected value.
+		err    bool     // Expected error.
+	}{
+		{"", Metadata{}, false},
+		{"{}", Metadata{}, false},
+		{`{"weight":10,"region":"us-east","zone":"us-east-1a","tags":["a","b"],"protocol":"http","build_sha":"abc"}`,
+			Metadata{Weight: 10, Region: "us-east", Zone: "us-east-1a", Tags: []string{"a", "b"}, Protocol: "http", BuildSHA: "abc"}, false},
+		{`{"weight":2,"unknown":true}`, Metadata{Weight: 2}, false},
+		{"not json", Metadata{}, true},
+	} {
+		got, err := parseMetadata([]byte(elem.data))
+		if elem.err && err == nil {
+			t.Errorf("[%s] Expected error, got <nil>", elem.data)
+		} else if !elem.err && err != nil {
+			t.Errorf("[%s] Unexpected error: %s", elem.data, err)
+		}
+		if !reflect.DeepEqual(elem.expect, got) {
+			t.Errorf("[%s] Unexpected result.\nExpect:\t%+v\nGot:\t%+v", elem.data, elem.expect, got)
+		}
+	}
+}
+
+func TestEncodeMetadata(t *testing.T) {
+	meta := Metadata{Weight: 3, Zone: "zone", Tags: []string{"canary"}}
+	data, err := encodeMetadata(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(meta, got) {
+		t.Fatalf("Unexpected result.\nExpect:\t%+v\nGot:\t%+v", meta, got)
+	}
+}
@@ -0,0 +1,113 @@
+package zkregistry
+
+import (
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// Option configures the registry at construction, see New.
+type Option func(*ZKRegistry)
+
+// WithTickInterval sets the interval of the full reconciliation with zookeeper (10s by default).
+// Each reconciliation lists the tree and reads every endpoint node.
+// A zero or negative interval disables it.
+func WithTickInterval(d time.Duration) Option {
+	return func(reg *ZKRegistry) {
+		reg.tickInterval = d
+	}
+}
+
+// WithSnapshotFile enables the on-disk cache of the registry state.
+// The state is written to the given file after each change and loaded when the
+// startup fails: when present, New does not fail if zookeeper is unreachable, the registry
+// serves the last known endpoints, flagged as stale (see Health), until the watch catches up.
+func WithSnapshotFile(file string) Option {
+	return func(reg *ZKRegistry) {
+		reg.snapshotFile = file
+	}
+}
+
+// WithLogger overrides the default logger.
+// Takes precedence over the logger given to New.
+func WithLogger(logger zk.Logger) Option {
+	return func(reg *ZKRegistry) {
+		reg.logger = logger
+	}
+}
+
+// WithSessionTimeout sets the zookeeper session timeout, see DefaultSessionTimeout.
+// Only used by Dial.
+func WithSessionTimeout(d time.Duration) Option {
+	return func(reg *ZKRegistry) {
+		reg.dial.sessionTimeout = d
+	}
+}
+
+// WithAuth adds credentials to the connection, i.e. WithAuth("digest", []byte("user:password")).
+// Only used by Dial, the credentials are re-applied after each reconnection.
+func WithAuth(scheme string, auth []byte) Option {
+	return func(reg *ZKRegistry) {
+		reg.dial.credentials = append(reg.dial.credentials, credential{scheme: scheme, auth: auth})
+	}
+}
+
+// WithDialer sets a custom dialer for the zookeeper connection.
+// Only used by Dial.
+func WithDialer(dialer zk.Dialer) Option {
+	return func(reg *ZKRegistry) {
+		reg.dial.dialer = dialer
+	}
+}
+
+// WithACLs sets the ACLs of the nodes created by the registry, by level.
+func WithACLs(acls ACLs) Option {
+	return func(reg *ZKRegistry) {
+		reg.acls = acls
+	}
+}
+
+// WithACLCheck verifies at startup that the existing nodes carry the expected ACLs, see WithACLs.
+// On degraded start from a snapshot, the check runs once the watch gets established:
+// with ACLCheckFail, a mismatch keeps the registry stale, serving the snapshot.
+func WithACLCheck(check ACLCheck) Option {
+	return func(reg *ZKRegistry) {
+		reg.aclCheck = check
+	}
+}
+
+// WithCuratorLayout uses the Apache Curator x-discovery layout instead of the
+// name/version/endpoint one: /<name>/<instance id> with a JSON ServiceInstance as data.
+// Use the Curator base path as registry path to share the tree with JVM services.
+// Endpoints must be host:port, the version and the metadata go in the instance payload.
+func WithCuratorLayout() Option {
+	return func(reg *ZKRegistry) {
+		reg.layout = CuratorLayout
+	}
+}
+
+// WithServersetLayout uses the Finagle/Aurora serverset layout instead of the
+// name/version/endpoint one: /<name>/member_<sequence> with a JSON ServiceInstance as data.
+// The primary endpoints are listed under the empty version and the additional ones
+// under their name. Registered endpoints must be host:port and are published both as
+// primary and as the additional endpoint named after the version.
+func WithServersetLayout() Option {
+	return func(reg *ZKRegistry) {
+		reg.layout = ServersetLayout
+	}
+}
+
+// WithLocalityRouting sets the locality of the client and the spillover thresholds of the locality-aware lookups,
+// see LookupLocal. The locality of the endpoints comes from their metadata, falling back to the network of their host.
+func WithLocalityRouting(cfg LocalityRouting) Option {
+	return func(reg *ZKRegistry) {
+		reg.locality = cfg
+	}
+}
+
+// WithLayout uses a custom tree layout instead of the name/version/endpoint one, see Layout.
+func WithLayout(layout Layout) Option {
+	return func(reg *ZKRegistry) {
+		reg.layout = layout
+	}
+}
@@ -0,0 +1,218 @@
+package zkregistry
+
+import (
+	"time"
+)
+
+// OutlierDetection configures the passive outlier ejection driven by Failure/Success.
+type OutlierDetection struct {
+	ConsecutiveFailures int           // Failures in a row before ejecting an endpoint. <= 0 disables the ejection.
+	BaseEjectionTime    time.Duration // Ejection duration, doubled on each consecutive ejection.
+	MaxEjectionTime     time.Duration // Cap on the ejection duration.
+	MaxEjectionPercent  int           // Maximum percentage of a service version's endpoints ejected at once. <= 0 or > 100 means 100.
+}
+
+// DefaultOutlierDetection is the outlier detection configuration used by New.
+var DefaultOutlierDetection = OutlierDetection{
+	ConsecutiveFailures: 5,
+	BaseEjectionTime:    30 * time.Second,
+	MaxEjectionTime:     5 * time.Minute,
+	MaxEjectionPercent:  50,
+}
+
+// endpointKey identifies an endpoint of a service name/version.
+type endpointKey struct {
+	name, version, endpoint string
+}
+
+// outlierState keeps track of the failures of an endpoint.
+type outlierState struct {
+	failures     int       // Consecutive failures since the last success or ejection.
+	ejections    int       // Consecutive ejections since the last success.
+	ejectedUntil time.Time // Readmission time.
+}
+
+// ejectionTime returns the ejection duration for the given ejection count.
+func (cfg OutlierDetection) ejectionTime(ejections int) time.Duration {
+	d := cfg.BaseEjectionTime
+	for i := 1; i < ejections; i++ {
+		if cfg.MaxEjectionTime > 0 && d >= cfg.MaxEjectionTime {
+			break
+		}
+		d *= 2
+	}
+	if cfg.MaxEjectionTime > 0 && d > cfg.MaxEjectionTime {
+		d = cfg.MaxEjectionTime
+	}
+	return d
+}
+
+// SetOutlierDetection overrides the default outlier detection configuration.
+// A MaxEjectionPercent outside of ]0, 100] is set to 100, i.e. no cap.
+func (reg *ZKRegistry) SetOutlierDetection(cfg OutlierDetection) *ZKRegistry {
+	if cfg.MaxEjectionPercent <= 0 || cfg.MaxEjectionPercent > 100 {
+		cfg.MaxEjectionPercent = 100
+	}
+	reg.outlierLock.Lock()
+	reg.outlierConfig = cfg
+	reg.outlierLock.Unlock()
+	return reg
+}
+
+// Failure marks the given endpoint for service name/version as failed.
+// The version can be an alias or a constraint, see SetAliases and LookupRange.
+// After too many consecutive failures, the endpoint is ejected from the
+// lookup results until its ejection time expires.
+// Endpoints unknown to the registry are ignored.
+func (reg *ZKRegistry) Failure(name, version, endpoint string, err error) {
+	reg.logger.Printf("Error accessing %s/%s (%s): %s", name, version, endpoint, err)
+
+	// Lookup the current endpoints, used for the ejection cap.
+	current := reg.catalog()
+	version = current.resolveEndpoint(name, version, endpoint) // Aliases and ranges share the state of their target.
+	list, ok := current.lookup(name, version)
+	if !ok || !list.contains(endpoint) {
+		return
+	}
+	targets := list.endpoints
+	total := len(targets)
+
+	now := time.Now()
+	key := endpointKey{name: name, version: version, endpoint: endpoint}
+
+	reg.outlierLock.Lock()
+	defer reg.outlierLock.Unlock()
+
+	cfg := reg.outlierConfig
+	if cfg.ConsecutiveFailures <= 0 {
+		return
+	}
+	state, ok := reg.outliers[key]
+	if !ok {
+		state = &outlierState{}
+		reg.outliers[key] = state
+	}
+	if now.Before(state.ejectedUntil) { // Already ejected.
+		return
+	}
+	state.failures++
+	if state.failures < cfg.ConsecutiveFailures {
+		return
+	}
+
+	// Enforce the ejection cap.
+	ejected := 0
+	for _, target := range targets {
+		if s, ok := reg.outliers[endpointKey{name: name, version: version, endpoint: target}]; ok && now.Before(s.ejectedUntil) {
+			ejected++
+		}
+	}
+	if (ejected+1)*100 > cfg.MaxEjectionPercent*total {
+		reg.logger.Printf("Not ejecting %s/%s (%s): %d/%d endpoints already ejected", name, version, endpoint, ejected, total)
+		return
+	}
+
+	state.failures = 0
+	state.ejections++
+	d := cfg.ejectionTime(state.ejections)
+	state.ejectedUntil = now.Add(d)
+	reg.updateEjectedLocked()
+	reg.logger.Printf("Ejecting %s/%s (%s) for %s", name, version, endpoint, d)
+}
+
+// Success marks the given endpoint for service name/version as healthy,
+// resetting its failure and ejection counters. As for Failure, the version can be an alias or a constraint.
+func (reg *ZKRegistry) Success(name, version, endpoint string) {
+	version = reg.catalog().resolveEndpoint(name, version, endpoint)
+	key := endpointKey{name: name, version: version, endpoint: endpoint}
+
+	reg.outlierLock.Lock()
+	if state, ok := reg.outliers[key]; ok {
+		delete(reg.outliers, key)
+		if !state.ejectedUntil.IsZero() {
+			reg.updateEjectedLocked()
+		}
+	}
+	reg.outlierLock.Unlock()
+}
+
+// updateEjectedLocked publishes the current ejection times for the lock-free lookups.
+// NOTE: expects reg.outlierLock to be held.
+func (reg *ZKRegistry) updateEjectedLocked() {
+	now := time.Now()
+	ejected := map[endpointKey]time.Time{}
+	for key, state := range reg.outliers {
+		if now.Before(state.ejectedUntil) {
+			ejected[key] = state.ejectedUntil
+		}
+	}
+	reg.ejected.Store(ejected)
+
+	// Wake up the waiters, see WaitFor.
+	previous := reg.ejectedChange.Load().(chan struct{})
+	reg.ejectedChange.Store(make(chan struct{}))
+	close(previous)
+}
+
+// nextReadmission returns the earliest readmission time of the ejected endpoints
+// of the given service name/version, zero if none is ejected.
+func (reg *ZKRegistry) nextReadmission(name, version string) time.Time {
+	now := time.Now()
+	var next time.Time
+	for key, until := range reg.ejected.Load().(map[endpointKey]time.Time) {
+		if key.name != name || key.version != version || !now.Before(until) {
+			continue
+		}
+		if next.IsZero() || until.Before(next) {
+			next = until
+		}
+	}
+	return next
+}
+
+// filterEjected removes the ejected endpoints from the given list.
+// If all the endpoints are ejected, the list is returned as is.
+// NOTE: does not lock nor modify the given list.
+func (reg *ZKRegistry) filterEjected(name, version string, list *endpointList) *endpointList {
+	ejected := reg.ejected.Load().(map[endpointKey]time.Time)
+	if len(ejected) == 0 {
+		return list
+	}
+
+	now := time.Now()
+	var filtered []Instance
+	for i, instance := range list.instances {
+		until, ok := ejected[endpointKey{name: name, version: version, endpoint: instance.Address}]
+		if !ok || !now.Before(until) {
+			if filtered != nil {
+				filtered = append(filtered, instance)
+			}
+			continue
+		}
+		if filtered == nil {
+			filtered = make([]Instance, i, len(list.instances))
+			copy(filtered, list.instances[:i])
+		}
+	}
+	if filtered == nil {
+		return list
+	}
+	if len(filtered) == 0 {
+		// Panic mode: everything is ejected, better try something than nothing.
+		return list
+	}
+	return newEndpointList(filtered)
+}
+
+// forgetOutliers removes the outlier state of the endpoints matching the given name/version/endpoint.
+// Empty version or endpoint match everything.
+func (reg *ZKRegistry) forgetOutliers(name, version, endpoint string) {
+	reg.outlierLock.Lock()
+	for key := range reg.outliers {
+		if key.name == name && (version == "" || key.version == version) && (endpoint == "" || key.endpoint == endpoint) {
+			delete(reg.outliers, key)
+		}
+	}
+	reg.updateEjectedLocked()
+	reg.outlierLock.Unlock()
+}
@@ -0,0 +1,162 @@
+package zkregistry
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestOutlierEjectionTime(t *testing.T) {
+	cfg := OutlierDetection{BaseEjectionTime: time.Second, MaxEjectionTime: 5 * time.Second}
+	for ejections, expect := range []time.Duration{
+		1: time.Second,
+		2: 2 * time.Second,
+		3: 4 * time.Second,
+		4: 5 * time.Second,
+		5: 5 * time.Second,
+	} {
+		if ejections == 0 {
+			continue
+		}
+		if got := cfg.ejectionTime(ejections); expect != got {
+			t.Errorf("[%d] Unexpected ejection time.\nExpect:\t%s\nGot:\t%s", ejections, expect, got)
+		}
+	}
+}
+
+func TestOutlierEjection(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	conn.SetOutlierDetection(OutlierDetection{
+		ConsecutiveFailures: 2,
+		BaseEjectionTime:    50 * time.Millisecond,
+		MaxEjectionTime:     time.Second,
+		MaxEjectionPercent:  50,
+	})
+	conn.Add("name", "version", "addr1")
+	conn.Add("name", "version", "addr2")
+	conn.Add("name", "version", "addr3")
+
+	errFailure := errors.New("failure")
+
+	// One failure is not enough to eject.
+	conn.Failure("name", "version", "addr1", errFailure)
+	assertLookupResult(t, conn, "name", "version", []string{"addr1", "addr2", "addr3"}, nil)
+
+	// Second consecutive failure ejects the endpoint.
+	conn.Failure("name", "version", "addr1", errFailure)
+	assertLookupResult(t, conn, "name", "version", []string{"addr2", "addr3"}, nil)
+
+	// The picker should not return the ejected endpoint.
+	p := conn.Picker("name", "version", RoundRobin)
+	for i := 0; i < 10; i++ {
+		if got, err := p.Next(); err != nil {
+			t.Fatal(err)
+		} else if got == "addr1" {
+			t.Fatalf("[%d] Picker returned ejected endpoint", i)
+		}
+	}
+
+	// Ejecting a 2nd endpoint would go over the 50% cap.
+	conn.Failure("name", "version", "addr2", errFailure)
+	conn.Failure("name", "version", "addr2", errFailure)
+	assertLookupResult(t, conn, "name", "version", []string{"addr2", "addr3"}, nil)
+
+	// Wait for the readmission.
+	time.Sleep(60 * time.Millisecond)
+	assertLookupResult(t, conn, "name", "version", []string{"addr1", "addr2", "addr3"}, nil)
+
+	// The next ejection lasts twice as long.
+	conn.Failure("name", "version", "addr1", errFailure)
+	conn.Failure("name", "version", "addr1", errFailure)
+	assertLookupResult(t, conn, "name", "version", []string{"addr2", "addr3"}, nil)
+	time.Sleep(60 * time.Millisecond)
+	assertLookupResult(t, conn, "name", "version", []string{"addr2", "addr3"}, nil)
+
+	// Success resets the counters.
+	conn.Success("name", "version", "addr1")
+	assertLookupResult(t, conn, "name", "version", []string{"addr1", "addr2", "addr3"}, nil)
+	conn.Failure("name", "version", "addr1", errFailure)
+	assertLookupResult(t, conn, "name", "version", []string{"addr1", "addr2", "addr3"}, nil)
+}
+
+func TestOutlierEjectionDisabled(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	conn.SetOutlierDetection(OutlierDetection{})
+	conn.Add("name", "version", "addr1")
+	conn.Add("name", "version", "addr2")
+
+	for i := 0; i < 10; i++ {
+		conn.Failure("name", "version", "addr1", errors.New("failure"))
+	}
+	assertLookupResult(t, conn, "name", "version", []string{"addr1", "addr2"}, nil)
+}
+
+// Make sure the outlier state goes away with the endpoint.
+func TestOutlierForget(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	conn.SetOutlierDetection(OutlierDetection{
+		ConsecutiveFailures: 1,
+		BaseEjectionTime:    time.Minute,
+		MaxEjectionPercent:  100,
+	})
+	conn.Add("name", "version", "addr1")
+	conn.Add("name", "version", "addr2")
+	conn.Failure("name", "version", "addr1", errors.New("failure"))
+	assertLookupResult(t, conn, "name", "version", []string{"addr2"}, nil)
+
+	conn.DeleteService("name")
+	conn.Add("name", "version", "addr1")
+	assertLookupResult(t, conn, "name", "version", []string{"addr1"}, nil)
+}
+
+// Make sure failures on unknown endpoints do not accumulate state.
+func TestOutlierUnknownEndpoint(t *testing.T) {
+	reg := newTestRegistry()
+	reg.logger = discardLogger
+	reg.SetOutlierDetection(OutlierDetection{ConsecutiveFailures: 1})
+	reg.Add("name", "version", "addr1")
+
+	reg.Failure("name", "version", "addr2", errors.New("failure"))
+	reg.Failure("name", "other", "addr1", errors.New("failure"))
+	reg.Failure("other", "version", "addr1", errors.New("failure"))
+	if len(reg.outliers) != 0 {
+		t.Fatalf("Unexpected outlier state for unknown endpoints: %v", reg.outliers)
+	}
+}
+
+// Make sure a zero MaxEjectionPercent does not prevent the ejection.
+func TestOutlierNoEjectionCap(t *testing.T) {
+	reg := newTestRegistry()
+	reg.logger = discardLogger
+	reg.SetOutlierDetection(OutlierDetection{ConsecutiveFailures: 1, BaseEjectionTime: time.Minute})
+	reg.Add("name", "version", "addr1")
+	reg.Add("name", "version", "addr2")
+
+	reg.Failure("name", "version", "addr1", errors.New("failure"))
+	assertLookupResult(t, &zkConn{ZKRegistry: reg}, "name", "version", []string{"addr2"}, nil)
+}
+
+// Make sure the failures through an alias count for its target.
+func TestOutlierAlias(t *testing.T) {
+	reg := newTestRegistry()
+	reg.logger = discardLogger
+	reg.SetOutlierDetection(OutlierDetection{ConsecutiveFailures: 2, BaseEjectionTime: time.Minute})
+	reg.Add("name", "v1", "addr1")
+	reg.Add("name", "v1", "addr2")
+	reg.setAliases("name", map[string]string{"stable": "v1"})
+
+	reg.Failure("name", "stable", "addr1", errors.New("failure"))
+	reg.Failure("name", "v1", "addr1", errors.New("failure"))
+	conn := &zkConn{ZKRegistry: reg}
+	assertLookupResult(t, conn, "name", "v1", []string{"addr2"}, nil)
+	assertLookupResult(t, conn, "name", "stable", []string{"addr2"}, nil)
+
+	reg.Success("name", "stable", "addr1")
+	assertLookupResult(t, conn, "name", "v1", []string{"addr1", "addr2"}, nil)
+}
@@ -0,0 +1,52 @@
+package zkregistry
+
+import (
+	"sync/atomic"
+)
+
+// SetOwnerTracking enables the confirmation of the endpoint removals.
+// When several processes register the same address, only one of them owns the node
+// and the others re-create it when it goes away (see Register). With tracking enabled,
+// a removal is only applied once the watcher confirms the node is gone, i.e. no other
+// session re-created it in the meantime, so the endpoint does not flap when one of the
+// processes leaves. A re-created node is read again, its new owner may publish other metadata.
+func (reg *ZKRegistry) SetOwnerTracking(enabled bool) *ZKRegistry {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&reg.trackOwners, v)
+	return reg
+}
+
+// ownerTracking returns whether owner tracking is enabled, see SetOwnerTracking.
+func (reg *ZKRegistry) ownerTracking() bool {
+	return atomic.LoadInt32(&reg.trackOwners) == 1
+}
+
+// release removes the given registration from the registry and returns another
+// live registration of the same endpoint node, if any.
+// All the registrations of a registry share the same session, so the node is
+// reference counted: only the last registration to go away removes it.
+func (reg *ZKRegistry) release(r *Registration) *Registration {
+	reg.regLock.Lock()
+	defer reg.regLock.Unlock()
+
+	delete(reg.registrations, r)
+	zkPath := r.Path()
+	for other := range reg.registrations {
+		if other.Path() == zkPath {
+			return other
+		}
+	}
+	return nil
+}
+
+// adopt hands over the ownership of the node to the registration, if it does not have one yet.
+func (r *Registration) adopt(owner int64) {
+	r.lock.Lock()
+	if r.owner == 0 {
+		r.owner = owner
+	}
+	r.lock.Unlock()
+}
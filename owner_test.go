@@ -0,0 +1,100 @@
+package zkregistry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/agrarianlabs/zkwatcher"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// Make sure a removal is discarded when another session re-created the node.
+func TestOwnerTracking(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+	conn.SetOwnerTracking(true)
+
+	// Create the endpoint from another session.
+	other, _, err := zk.Connect([]string{testZKHost}, 1*time.Second)
+	if err != nil {
+		t.Fatalf("Unable to connect to ZK: %s", err)
+	}
+	defer other.Close()
+	other.SetLogger(discardLogger)
+
+	assertCreateTree(t, conn, "/discovery/name/version")
+	zkPath := conn.nodePath([]string{"name", "version", "addr"})
+	if _, err := other.Create(zkPath, nil, zk.FlagEphemeral, zk.WorldACL(zk.PermAll)); err != nil {
+		t.Fatalf("Error creating %q: %s", zkPath, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	assertLookupResult(t, conn, "name", "version", []string{"addr"}, nil)
+
+	// Simulate the removal of the previous owner's node, re-created by another session:
+	// the watcher does not confirm it is gone, keep the endpoint.
+	conn.handleEvent(zkwatcher.Event{Path: zkPath, Type: zkwatcher.Delete})
+	assertLookupResult(t, conn, "name", "version", []string{"addr"}, nil)
+
+	// The re-created node is read again, the watcher only reports the removal.
+	data, err := conn.layout.Encode(Key{Name: "name", Version: "version", Endpoint: "addr"}, "addr", Metadata{Zone: "b"})
+	if err != nil {
+		t.Fatalf("Error encoding the metadata: %s", err)
+	}
+	if _, err := other.Multi(
+		&zk.DeleteRequest{Path: zkPath, Version: -1},
+		&zk.CreateRequest{Path: zkPath, Data: data, Acl: zk.WorldACL(zk.PermAll), Flags: zk.FlagEphemeral},
+	); err != nil {
+		t.Fatalf("Error re-creating %q: %s", zkPath, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	assertLookupResult(t, conn, "name", "version", []string{"addr"}, nil)
+	if instances, _ := conn.LookupInstances("name", "version"); len(instances) != 1 || instances[0].Metadata.Zone != "b" {
+		t.Fatalf("Metadata should have been refreshed: %+v", instances)
+	}
+
+	// Once the node is really gone, the endpoint goes away.
+	if err := other.Delete(zkPath, -1); err != nil {
+		t.Fatalf("Error removing %q: %s", zkPath, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	assertLookupResult(t, conn, "name", "version", []string{}, nil)
+}
+
+func TestOwnerTrackingDisabled(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	assertCreateTree(t, conn, "/discovery/name/version/addr")
+	time.Sleep(100 * time.Millisecond)
+	assertLookupResult(t, conn, "name", "version", []string{"addr"}, nil)
+
+	// Without tracking, the removal event is applied as is.
+	zkPath := conn.nodePath([]string{"name", "version", "addr"})
+	conn.handleEvent(zkwatcher.Event{Path: zkPath, Type: zkwatcher.Delete})
+	assertLookupResult(t, conn, "name", "version", []string{}, nil)
+}
+
+// Make sure the registrations of the same endpoint share the node.
+func TestRegisterShared(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	r1, err := conn.Register("name", "version", "addr")
+	if err != nil {
+		t.Fatalf("Error registering endpoint: %s", err)
+	}
+	r2, err := conn.Register("name", "version", "addr")
+	if err != nil {
+		t.Fatalf("Error registering endpoint: %s", err)
+	}
+
+	if err := r1.Deregister(); err != nil {
+		t.Fatalf("Error deregistering endpoint: %s", err)
+	}
+	assertZKPathExist(t, conn, r2.Path())
+
+	if err := r2.Deregister(); err != nil {
+		t.Fatalf("Error deregistering endpoint: %s", err)
+	}
+	assertZKPathNotExist(t, conn, r2.Path())
+}
@@ -0,0 +1,203 @@
+package zkregistry
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshotFileVersion is the version of the on-disk snapshot format.
+const snapshotFileVersion = 1
+
+// snapshotFile is the on-disk snapshot format.
+type snapshotFile struct {
+	Version  int             `json:"version"`
+	Time     time.Time       `json:"time"`              // Write time.
+	Checksum string          `json:"checksum"`          // Hex encoded sha256 of `services` followed by `aliases` and `splits`.
+	Services json.RawMessage `json:"services"`          // map[name]map[version][]Instance.
+	Aliases  json.RawMessage `json:"aliases,omitempty"` // map[name]map[alias]version.
+	Splits   json.RawMessage `json:"splits,omitempty"`  // map[name]map[version]weight.
+}
+
+// checksum returns the checksum of the snapshot content.
+func (file *snapshotFile) checksum() string {
+	sum := sha256.Sum256(append(append(append([]byte(nil), file.Services...), file.Aliases...), file.Splits...))
+	return hex.EncodeToString(sum[:])
+}
+
+// encodeSnapshotFile encodes the given catalog in the on-disk format.
+func encodeSnapshotFile(c *catalog) ([]byte, error) {
+	services := make(map[string]map[string][]Instance, len(c.services))
+	for name, versions := range c.services {
+		services[name] = make(map[string][]Instance, len(versions))
+		for version, list := range versions {
+			services[name][version] = list.instances
+		}
+	}
+	data, err := json.Marshal(services)
+	if err != nil {
+		return nil, err
+	}
+	file := &snapshotFile{
+		Version:  snapshotFileVersion,
+		Time:     time.Now(),
+		Services: data,
+	}
+	if len(c.aliases) > 0 {
+		if file.Aliases, err = json.Marshal(c.aliases); err != nil {
+			return nil, err
+		}
+	}
+	if len(c.splits) > 0 {
+		if file.Splits, err = json.Marshal(c.splits); err != nil {
+			return nil, err
+		}
+	}
+	file.Checksum = file.checksum()
+	return json.Marshal(file) // NOTE: pointer for the json.RawMessage fields.
+}
+
+// decodeSnapshotFile decodes and verifies the given on-disk snapshot.
+func decodeSnapshotFile(buf []byte) (*snapshotFile, map[string]map[string][]Instance, error) {
+	var file snapshotFile
+	if err := json.Unmarshal(buf, &file); err != nil {
+		return nil, nil, fmt.Errorf("invalid snapshot: %s", err)
+	}
+	if file.Version != snapshotFileVersion {
+		return nil, nil, fmt.Errorf("unsupported snapshot version: %d", file.Version)
+	}
+	if file.checksum() != file.Checksum {
+		return nil, nil, fmt.Errorf("snapshot checksum mismatch")
+	}
+	var services map[string]map[string][]Instance
+	if err := json.Unmarshal(file.Services, &services); err != nil {
+		return nil, nil, fmt.Errorf("invalid snapshot services: %s", err)
+	}
+	return &file, services, nil
+}
+
+// decodeSnapshotServiceData decodes the aliases and the splits of the given verified snapshot, see decodeSnapshotFile.
+func decodeSnapshotServiceData(file *snapshotFile) (map[string]map[string]string, map[string]map[string]int, error) {
+	aliases := map[string]map[string]string{}
+	if len(file.Aliases) > 0 {
+		if err := json.Unmarshal(file.Aliases, &aliases); err != nil {
+			return nil, nil, fmt.Errorf("invalid snapshot aliases: %s", err)
+		}
+	}
+	splits := map[string]map[string]int{}
+	if len(file.Splits) > 0 {
+		if err := json.Unmarshal(file.Splits, &splits); err != nil {
+			return nil, nil, fmt.Errorf("invalid snapshot splits: %s", err)
+		}
+	}
+	return aliases, splits, nil
+}
+
+// writeFileAtomic writes the given data to a temporary file and renames it,
+// so the file is never seen partially written.
+func writeFileAtomic(file string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()           // Best effort.
+		_ = os.Remove(tmp.Name()) // Best effort.
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()           // Best effort.
+		_ = os.Remove(tmp.Name()) // Best effort.
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name()) // Best effort.
+		return err
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		_ = os.Remove(tmp.Name()) // Best effort.
+		return err
+	}
+	return nil
+}
+
+// loadSnapshot loads the on-disk snapshot and flags the registry as stale.
+// Returns false if there is no usable snapshot.
+func (reg *ZKRegistry) loadSnapshot() bool {
+	buf, err := ioutil.ReadFile(reg.snapshotFile)
+	if os.IsNotExist(err) {
+		return false
+	} else if err != nil {
+		reg.logger.Printf("error reading snapshot %q: %s", reg.snapshotFile, err)
+		return false
+	}
+	file, services, err := decodeSnapshotFile(buf)
+	if err != nil {
+		reg.logger.Printf("error loading snapshot %q: %s", reg.snapshotFile, err)
+		return false
+	}
+
+	aliases, splits, err := decodeSnapshotServiceData(file)
+	if err != nil {
+		reg.logger.Printf("error loading snapshot %q: %s", reg.snapshotFile, err)
+		return false
+	}
+
+	next := &catalog{services: make(map[string]map[string]*endpointList, len(services)), aliases: aliases, splits: splits}
+	for name, versions := range services {
+		next.services[name] = make(map[string]*endpointList, len(versions))
+		for version, instances := range versions {
+			if instances == nil {
+				instances = []Instance{}
+			}
+			next.services[name][version] = newEndpointList(instances)
+		}
+	}
+	reg.lock.Lock()
+	reg.commitLocked(next)
+	reg.lock.Unlock()
+
+	reg.statsLock.Lock()
+	reg.staleSince = time.Now()
+	reg.statsLock.Unlock()
+
+	reg.logger.Printf("Loaded %d services from snapshot %q written at %s", len(services), reg.snapshotFile, file.Time)
+	return true
+}
+
+// snapshotWriter writes the registry state to the snapshot file after each change.
+func (reg *ZKRegistry) snapshotWriter() {
+	written := reg.catalog().revision // Either empty or just loaded, nothing to write.
+	write := func(current *catalog) {
+		if current.revision == written {
+			return
+		}
+		data, err := encodeSnapshotFile(current)
+		if err == nil {
+			err = writeFileAtomic(reg.snapshotFile, data)
+		}
+		if err != nil {
+			reg.logger.Printf("error writing snapshot %q: %s", reg.snapshotFile, err)
+			return
+		}
+		written = current.revision
+	}
+
+	for {
+		current := reg.catalog()
+		write(current)
+
+		select {
+		case <-reg.stopChan:
+			// Flush the latest changes.
+			write(reg.catalog())
+			return
+		case <-current.changed:
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package zkregistry
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+func TestSnapshotFileEncoding(t *testing.T) {
+	c := newCatalog().withVersion("name", "version", newEndpointList([]Instance{
+		{Address: "addr1", Metadata: Metadata{Zone: "a", Tags: []string{"x"}}},
+		{Address: "addr2"},
+	}))
+
+	buf, err := encodeSnapshotFile(c)
+	if err != nil {
+		t.Fatalf("Error encoding the snapshot: %s", err)
+	}
+	_, services, err := decodeSnapshotFile(buf)
+	if err != nil {
+		t.Fatalf("Error decoding the snapshot: %s", err)
+	}
+	list, _ := c.lookup("name", "version")
+	if expect, got := list.instances, services["name"]["version"]; !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected instances.\nExpect:\t%v\nGot:\t%v", expect, got)
+	}
+
+	// Corrupted content.
+	corrupted := bytes.Replace(buf, []byte("addr2"), []byte("addr3"), 1)
+	if _, _, err := decodeSnapshotFile(corrupted); err == nil || err.Error() != "snapshot checksum mismatch" {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Unknown version.
+	future := bytes.Replace(buf, []byte(`"version":1`), []byte(`"version":2`), 1)
+	if _, _, err := decodeSnapshotFile(future); err == nil || err.Error() != "unsupported snapshot version: 2" {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, _, err := decodeSnapshotFile([]byte("{")); err == nil {
+		t.Fatal("Invalid json should fail")
+	}
+
+	// Aliases and splits, covered by the checksum.
+	buf, err = encodeSnapshotFile(c.withAliases("name", map[string]string{"stable": "version"}).withSplit("name", map[string]int{"version": 1}))
+	if err != nil {
+		t.Fatalf("Error encoding the snapshot: %s", err)
+	}
+	file, _, err := decodeSnapshotFile(buf)
+	if err != nil {
+		t.Fatalf("Error decoding the snapshot: %s", err)
+	}
+	aliases, splits, err := decodeSnapshotServiceData(file)
+	if err != nil || !reflect.DeepEqual(map[string]map[string]string{"name": {"stable": "version"}}, aliases) {
+		t.Fatalf("Unexpected aliases: %v (%v)", aliases, err)
+	}
+	if !reflect.DeepEqual(map[string]map[string]int{"name": {"version": 1}}, splits) {
+		t.Fatalf("Unexpected splits: %v", splits)
+	}
+	for _, corrupted := range [][]byte{
+		bytes.Replace(buf, []byte(`"stable":"version"`), []byte(`"stable":"other"`), 1),
+		bytes.Replace(buf, []byte(`"version":1}`), []byte(`"version":2}`), 1),
+	} {
+		if _, _, err := decodeSnapshotFile(corrupted); err == nil || err.Error() != "snapshot checksum mismatch" {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+}
+
+// tempSnapshotFile returns a snapshot file path in a new temporary directory, along with a cleanup func.
+func tempSnapshotFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "zkregistry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "snapshot.json"), func() { _ = os.RemoveAll(dir) }
+}
+
+// Make sure the registry serves the snapshot when zookeeper is unreachable at startup.
+func TestSnapshotFileColdStart(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	file, cleanup := tempSnapshotFile(t)
+	defer cleanup()
+
+	assertCreateTree(t, conn, "/test/discovery/name/version/addr1")
+	assertCreateTree(t, conn, "/test/discovery/name/version/addr2")
+
+	reg, err := New(conn.conn, path.Join(conn.prefix, "/test/discovery"), discardLogger, WithSnapshotFile(file))
+	if err != nil {
+		t.Fatalf("Error creating new registry: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := reg.WaitFor(ctx, "name", "version", 2); err != nil {
+		t.Fatalf("Error waiting for the endpoints: %s", err)
+	}
+	if err := reg.Close(); err != nil {
+		t.Fatalf("Error closing the registry: %s", err)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("The snapshot should have been written: %s", err)
+	}
+
+	// Start again without zookeeper.
+	p := newTCPProxy(t, "321.321.321.321:321")
+	p.Start()
+	defer p.Stop()
+	deadConn, _, err := zk.Connect([]string{p.URL}, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deadConn.Close()
+	deadConn.SetLogger(discardLogger)
+
+	reg, err = New(deadConn, path.Join(conn.prefix, "/test/discovery"), discardLogger, WithSnapshotFile(file))
+	if err != nil {
+		t.Fatalf("The registry should start from the snapshot: %s", err)
+	}
+	got, err := reg.Lookup("name", "version")
+	if err != nil {
+		t.Fatalf("Error looking up the registry: %s", err)
+	}
+	got = append([]string(nil), got...)
+	sort.Strings(got)
+	if expect := []string{"addr1", "addr2"}; !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected endpoints.\nExpect:\t%v\nGot:\t%v", expect, got)
+	}
+	if h := reg.Health(); h.Ready() || !h.Stale || h.Synced {
+		t.Fatalf("The registry should be stale: %+v", h)
+	}
+
+	if err := testTimeout(t, "close degraded registry", 5*time.Second, func(t *testing.T) {
+		_ = reg.Close() // Best effort.
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Make sure the snapshot is only used when zookeeper is unreachable, and gets refreshed.
+func TestSnapshotFileCatchUp(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	file, cleanup := tempSnapshotFile(t)
+	defer cleanup()
+
+	// Snapshot with an endpoint gone since.
+	data, err := encodeSnapshotFile(newCatalog().withVersion("name", "version", newEndpointList([]Instance{
+		{Address: "addr1"},
+		{Address: "ghost"},
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(file, data); err != nil {
+		t.Fatal(err)
+	}
+	assertCreateTree(t, conn, "/test/discovery/name/version/addr1")
+
+	reg, err := New(conn.conn, path.Join(conn.prefix, "/test/discovery"), discardLogger, WithSnapshotFile(file))
+	if err != nil {
+		t.Fatalf("Error creating new registry: %s", err)
+	}
+	defer func() { _ = reg.Close() }() // Best effort.
+	if h := reg.Health(); h.Stale {
+		t.Fatalf("The registry should not start from the snapshot: %+v", h)
+	}
+	if got, _ := reg.Lookup("name", "version"); len(got) > 1 {
+		t.Fatalf("The registry should not serve the snapshot: %v", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := reg.WaitSynced(ctx); err != nil {
+		t.Fatalf("Error waiting for the registry to sync: %s", err)
+	}
+	if got, err := reg.Lookup("name", "version"); err != nil {
+		t.Fatalf("Error looking up the registry: %s", err)
+	} else if expect := []string{"addr1"}; !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected endpoints.\nExpect:\t%v\nGot:\t%v", expect, got)
+	}
+	if h := reg.Health(); !h.Ready() {
+		t.Fatalf("The registry should be ready: %+v", h)
+	}
+
+	// The catch up got written.
+	time.Sleep(100 * time.Millisecond)
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, services, err := decodeSnapshotFile(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect, got := []Instance{{Address: "addr1"}}, services["name"]["version"]; !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected snapshot.\nExpect:\t%v\nGot:\t%v", expect, got)
+	}
+}
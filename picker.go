@@ -0,0 +1,113 @@
+package zkregistry
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+)
+
+// Strategy is the load balancing strategy used by a Picker.
+type Strategy int
+
+// Strategy enum values.
+const (
+	RoundRobin Strategy = iota
+	Random
+	WeightedRandom
+)
+
+func (s Strategy) String() string {
+	switch s {
+	case RoundRobin:
+		return "round-robin"
+	case Random:
+		return "random"
+	case WeightedRandom:
+		return "weighted-random"
+	default:
+		return "unknown"
+	}
+}
+
+// Picker selects one endpoint of a service name/version.
+// The endpoint list is looked up on each call so the picker
+// always reflects the current state of the registry.
+type Picker struct {
+	counter uint64 // Round robin counter. NOTE: first for 64bit alignment.
+
+	reg      *ZKRegistry
+	name     string
+	version  string
+	strategy Strategy
+	local    bool // Restricted to the closest locality, see LookupLocal.
+}
+
+// Picker creates a new picker for the service name/version using the given strategy.
+func (reg *ZKRegistry) Picker(name, version string, strategy Strategy) *Picker {
+	return &Picker{
+		reg:      reg,
+		name:     name,
+		version:  version,
+		strategy: strategy,
+	}
+}
+
+// LocalPicker creates a new picker for the service name/version using the given strategy,
+// restricted to the endpoints of the closest locality, see LookupLocal.
+func (reg *ZKRegistry) LocalPicker(name, version string, strategy Strategy) *Picker {
+	p := reg.Picker(name, version, strategy)
+	p.local = true
+	return p
+}
+
+// Next returns the next endpoint to use.
+func (p *Picker) Next() (string, error) {
+	lookup := p.reg.LookupInstances
+	if p.local {
+		lookup = p.reg.LookupInstancesLocal
+	}
+	instances, err := lookup(p.name, p.version)
+	if err != nil {
+		return "", err
+	}
+	if len(instances) == 0 {
+		return "", ErrNoEndpoints
+	}
+
+	switch p.strategy {
+	case RoundRobin:
+		n := atomic.AddUint64(&p.counter, 1) - 1
+		return instances[n%uint64(len(instances))].Address, nil
+	case Random:
+		return instances[rand.Intn(len(instances))].Address, nil
+	case WeightedRandom:
+		return pickWeighted(instances, rand.Intn), nil
+	default:
+		return "", fmt.Errorf("unknown strategy: %d", p.strategy)
+	}
+}
+
+// weight returns the weight of the given instance, defaulting to 1.
+func weight(instance Instance) int {
+	if instance.Metadata.Weight <= 0 {
+		return 1
+	}
+	return instance.Metadata.Weight
+}
+
+// pickWeighted selects an instance proportionally to its weight.
+// `intn` is expected to behave like rand.Intn.
+// NOTE: expects a non-empty instance list.
+func pickWeighted(instances []Instance, intn func(int) int) string {
+	total := 0
+	for _, instance := range instances {
+		total += weight(instance)
+	}
+	n := intn(total)
+	for _, instance := range instances {
+		if n -= weight(instance); n < 0 {
+			return instance.Address
+		}
+	}
+	return instances[len(instances)-1].Address
+}
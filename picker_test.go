@@ -0,0 +1,109 @@
+package zkregistry
+
+import (
+	"testing"
+)
+
+func TestPickerRoundRobin(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	conn.Add("name", "version", "addr1")
+	conn.Add("name", "version", "addr2")
+	conn.Add("name", "version", "addr3")
+
+	p := conn.Picker("name", "version", RoundRobin)
+	for i, expect := range []string{"addr1", "addr2", "addr3", "addr1", "addr2", "addr3"} {
+		if got, err := p.Next(); err != nil {
+			t.Fatalf("[%d] Error picking endpoint: %s", i, err)
+		} else if expect != got {
+			t.Fatalf("[%d] Unexpected endpoint.\nExpect:\t%s\nGot:\t%s", i, expect, got)
+		}
+	}
+
+	// Remove an endpoint, the picker should never return it.
+	conn.DeleteEndpoint("name", "version", "addr2")
+	for i := 0; i < 10; i++ {
+		if got, err := p.Next(); err != nil {
+			t.Fatalf("[%d] Error picking endpoint: %s", i, err)
+		} else if got != "addr1" && got != "addr3" {
+			t.Fatalf("[%d] Unexpected endpoint: %s", i, got)
+		}
+	}
+}
+
+func TestPickerRandom(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	conn.Add("name", "version", "addr1")
+	conn.Add("name", "version", "addr2")
+
+	seen := map[string]int{}
+	p := conn.Picker("name", "version", Random)
+	for i := 0; i < 1000; i++ {
+		got, err := p.Next()
+		if err != nil {
+			t.Fatalf("[%d] Error picking endpoint: %s", i, err)
+		}
+		seen[got]++
+	}
+	if len(seen) != 2 || seen["addr1"] == 0 || seen["addr2"] == 0 {
+		t.Fatalf("Unexpected distribution: %v", seen)
+	}
+}
+
+func TestPickerWeightedRandom(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	conn.add("name", "version", "addr1", Metadata{Weight: 9})
+	conn.add("name", "version", "addr2", Metadata{Weight: 1})
+
+	seen := map[string]int{}
+	p := conn.Picker("name", "version", WeightedRandom)
+	for i := 0; i < 10000; i++ {
+		got, err := p.Next()
+		if err != nil {
+			t.Fatalf("[%d] Error picking endpoint: %s", i, err)
+		}
+		seen[got]++
+	}
+	// Expect ~90%/10%, allow some margin.
+	if seen["addr1"] < 8500 || seen["addr2"] < 500 {
+		t.Fatalf("Unexpected distribution: %v", seen)
+	}
+}
+
+func TestPickWeighted(t *testing.T) {
+	instances := []Instance{
+		{Address: "addr1", Metadata: Metadata{Weight: 2}},
+		{Address: "addr2"}, // Default weight: 1.
+		{Address: "addr3", Metadata: Metadata{Weight: 3}},
+	}
+	for n, expect := range []string{"addr1", "addr1", "addr2", "addr3", "addr3", "addr3"} {
+		if got := pickWeighted(instances, func(int) int { return n }); expect != got {
+			t.Errorf("[%d] Unexpected endpoint.\nExpect:\t%s\nGot:\t%s", n, expect, got)
+		}
+	}
+}
+
+func TestPickerErrors(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	if _, err := conn.Picker("name", "version", RoundRobin).Next(); err != ErrServiceNotFound {
+		t.Fatalf("Unexpected error.\nExpect:\t%v\nGot:\t%v", ErrServiceNotFound, err)
+	}
+
+	conn.Add("name", "version", "addr")
+	conn.DeleteEndpoint("name", "version", "addr")
+	if _, err := conn.Picker("name", "version", RoundRobin).Next(); err != ErrNoEndpoints {
+		t.Fatalf("Unexpected error.\nExpect:\t%v\nGot:\t%v", ErrNoEndpoints, err)
+	}
+
+	conn.Add("name", "version", "addr")
+	if _, err := conn.Picker("name", "version", Strategy(42)).Next(); err == nil {
+		t.Fatal("Unknown strategy should fail")
+	}
+}
@@ -0,0 +1,283 @@
+package zkregistry
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// Stats contains the runtime counters of the registry.
+type Stats struct {
+	Reconciliations  int64 `json:"reconciliations"`   // Completed full reconciliations.
+	ReconcileErrors  int64 `json:"reconcile_errors"`  // Reconciliations aborted on zookeeper error.
+	ReconcileAdded   int64 `json:"reconcile_added"`   // Missing endpoints added by the reconciliation.
+	ReconcileRemoved int64 `json:"reconcile_removed"` // Stale endpoints, versions, services, aliases or splits removed by the reconciliation.
+	ReconcileUpdated int64 `json:"reconcile_updated"` // Outdated endpoint metadata, aliases or splits refreshed by the reconciliation.
+	WatchErrors      int64 `json:"watch_errors"`      // Errors reported by the zookeeper watches.
+	Rewatches        int64 `json:"rewatches"`         // Watches re-established after an error.
+	SuspectedDrops   int64 `json:"suspected_drops"`   // Times the watcher channel got full, events may have been discarded.
+}
+
+// Stats returns the runtime counters of the registry.
+func (reg *ZKRegistry) Stats() Stats {
+	reg.statsLock.Lock()
+	defer reg.statsLock.Unlock()
+	return reg.stats
+}
+
+// reconcile lists the whole tree from zookeeper and repairs the drift
+// of the in-memory state, i.e. after missed or dropped watcher events.
+// Each correction gets logged and counted.
+// The endpoints added or removed through Add/DeleteEndpoint are left alone.
+// NOTE: expected to be called from the watcher goroutine, so no event gets applied concurrently.
+func (reg *ZKRegistry) reconcile() error {
+	state, err := reg.listState()
+	if err != nil {
+		reg.logger.Printf("Reconciliation failed: %s", err)
+		reg.statsLock.Lock()
+		reg.stats.ReconcileErrors++
+		reg.statsLock.Unlock()
+		return err
+	}
+
+	var added, removed, updated int64
+	current := reg.catalog()
+
+	// Stale state. The endpoints added locally are kept, see Add.
+	for name, versions := range current.services {
+		if _, ok := state.tree[name]; !ok && !reg.hasLocal(name, "") {
+			reg.logger.Printf("Reconciliation: removing stale service %s", name)
+			reg.DeleteService(name)
+			removed++
+			continue
+		}
+		for version, list := range versions {
+			endpoints, ok := state.tree[name][version]
+			if !ok && !reg.hasLocal(name, version) {
+				reg.logger.Printf("Reconciliation: removing stale version %s/%s", name, version)
+				reg.DeleteVersion(name, version)
+				removed++
+				continue
+			}
+			for _, endpoint := range list.endpoints {
+				if _, ok := endpoints[endpoint]; ok {
+					continue
+				}
+				if added, ok := reg.localChange(name, version, endpoint); ok && added {
+					continue
+				}
+				reg.logger.Printf("Reconciliation: removing stale endpoint %s/%s (%s)", name, version, endpoint)
+				reg.deleteEndpoint(name, version, endpoint)
+				removed++
+			}
+		}
+	}
+
+	// Missing or outdated endpoints, in listing order. The local changes are kept, see Add and DeleteEndpoint.
+	for _, e := range state.entries {
+		name, version, endpoint := e.Key.Name, e.Key.Version, e.Key.Endpoint
+		if _, ok := reg.localChange(name, version, endpoint); ok {
+			continue
+		}
+		meta := state.tree[name][version][endpoint] // The last node publishing the endpoint wins.
+		var previous *Metadata
+		if list, ok := reg.catalog().lookup(name, version); ok {
+			for _, instance := range list.instances {
+				if instance.Address == endpoint {
+					previous = &instance.Metadata
+					break
+				}
+			}
+		}
+		switch {
+		case previous == nil:
+			reg.logger.Printf("Reconciliation: adding missing endpoint %s/%s (%s)", name, version, endpoint)
+			reg.add(name, version, endpoint, meta)
+			added++
+		case !reflect.DeepEqual(*previous, meta):
+			reg.logger.Printf("Reconciliation: refreshing metadata of %s/%s (%s)", name, version, endpoint)
+			reg.setMetadata(name, version, endpoint, meta)
+			updated++
+		}
+	}
+	reg.nodes = state.nodes
+
+	// Outdated aliases and splits.
+	for name, aliases := range state.aliases {
+		if !reflect.DeepEqual(reg.catalog().aliases[name], aliases) {
+			reg.logger.Printf("Reconciliation: refreshing aliases of %s", name)
+			reg.setAliases(name, aliases)
+			updated++
+		}
+	}
+	for name := range reg.catalog().aliases {
+		if _, ok := state.aliases[name]; !ok {
+			reg.logger.Printf("Reconciliation: removing stale aliases of %s", name)
+			reg.setAliases(name, nil)
+			removed++
+		}
+	}
+	for name, split := range state.splits {
+		if !reflect.DeepEqual(reg.catalog().splits[name], split) {
+			reg.logger.Printf("Reconciliation: refreshing traffic split of %s", name)
+			reg.setSplit(name, split)
+			updated++
+		}
+	}
+	for name := range reg.catalog().splits {
+		if _, ok := state.splits[name]; !ok {
+			reg.logger.Printf("Reconciliation: removing stale traffic split of %s", name)
+			reg.setSplit(name, nil)
+			removed++
+		}
+	}
+
+	reg.statsLock.Lock()
+	reg.stats.Reconciliations++
+	reg.stats.ReconcileAdded += added
+	reg.stats.ReconcileRemoved += removed
+	reg.stats.ReconcileUpdated += updated
+	reg.lastSync = time.Now()
+	reg.statsLock.Unlock()
+	return nil
+}
+
+// setLocal records a change made through Add or DeleteEndpoint, ignored by the reconciliation.
+func (reg *ZKRegistry) setLocal(name, version, endpoint string, added bool) {
+	reg.lock.Lock()
+	reg.local[endpointKey{name: name, version: version, endpoint: endpoint}] = added
+	reg.lock.Unlock()
+}
+
+// clearLocal hands the given endpoint back to zookeeper, see setLocal.
+func (reg *ZKRegistry) clearLocal(name, version, endpoint string) {
+	reg.lock.Lock()
+	delete(reg.local, endpointKey{name: name, version: version, endpoint: endpoint})
+	reg.lock.Unlock()
+}
+
+// forgetLocalLocked discards the local changes of the given service name/version.
+// An empty version matches everything.
+// NOTE: expects reg.lock to be held.
+func (reg *ZKRegistry) forgetLocalLocked(name, version string) {
+	for key := range reg.local {
+		if key.name == name && (version == "" || key.version == version) {
+			delete(reg.local, key)
+		}
+	}
+}
+
+// localChange returns whether the given endpoint has been added or removed locally, if at all.
+func (reg *ZKRegistry) localChange(name, version, endpoint string) (added, ok bool) {
+	reg.lock.Lock()
+	added, ok = reg.local[endpointKey{name: name, version: version, endpoint: endpoint}]
+	reg.lock.Unlock()
+	return added, ok
+}
+
+// hasLocal returns whether endpoints have been added locally to the given service name/version.
+// An empty version matches everything.
+func (reg *ZKRegistry) hasLocal(name, version string) bool {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	for key, added := range reg.local {
+		if added && key.name == name && (version == "" || key.version == version) {
+			return true
+		}
+	}
+	return false
+}
+
+// treeState is the registry state listed from zookeeper, see listState.
+type treeState struct {
+	tree    map[string]map[string]map[string]Metadata // Endpoints by service name/version, including the parents without endpoints.
+	entries []Entry                                   // Endpoints in listing order.
+	nodes   map[string][]Entry                        // Endpoints published by each instance node.
+	aliases map[string]map[string]string              // Aliases by service name, only the services having some.
+	splits  map[string]map[string]int                 // Traffic splits by service name, only the services having one.
+}
+
+// listState lists and decodes the whole tree from zookeeper.
+func (reg *ZKRegistry) listState() (*treeState, error) {
+	elems, err := walkTree(reg.conn, reg.root, reg.layout.Depth())
+	if err != nil {
+		return nil, err
+	}
+
+	state := &treeState{
+		tree:    map[string]map[string]map[string]Metadata{},
+		nodes:   map[string][]Entry{},
+		aliases: map[string]map[string]string{},
+		splits:  map[string]map[string]int{},
+	}
+	ensure := func(name, version string) {
+		if _, ok := state.tree[name]; !ok {
+			state.tree[name] = map[string]map[string]Metadata{}
+		}
+		if _, ok := state.tree[name][version]; !ok {
+			state.tree[name][version] = map[string]Metadata{}
+		}
+	}
+	for _, node := range elems {
+		key, err := reg.parse(node)
+		if err != nil || key.Name == "" {
+			continue
+		}
+		if len(node) != reg.layout.Depth() {
+			if _, ok := state.tree[key.Name]; !ok {
+				state.tree[key.Name] = map[string]map[string]Metadata{}
+			}
+			if reg.isServiceNode(node, key) {
+				if err := reg.listServiceNode(state, node, key.Name); err != nil {
+					return nil, err
+				}
+			}
+			if key.Version != "" {
+				ensure(key.Name, key.Version)
+			}
+			continue
+		}
+		zkPath := reg.nodePath(node)
+		entries, ok, err := reg.readNode(zkPath, key)
+		if err != nil {
+			return nil, err
+		} else if !ok { // Removed in the meantime.
+			continue
+		}
+		state.nodes[zkPath] = entries
+		for _, e := range entries {
+			ensure(e.Key.Name, e.Key.Version)
+			state.tree[e.Key.Name][e.Key.Version][e.Key.Endpoint] = e.Metadata
+			state.entries = append(state.entries, e)
+		}
+	}
+	return state, nil
+}
+
+// listServiceNode reads the aliases and the traffic split of the given service node into the state.
+// Invalid data is logged, the last known state is kept.
+func (reg *ZKRegistry) listServiceNode(state *treeState, node []string, name string) error {
+	zkPath := reg.nodePath(node)
+	data, _, err := reg.conn.Get(zkPath)
+	if err == zk.ErrNoNode { // Removed in the meantime.
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error reading %q: %s", zkPath, err)
+	}
+	service, err := parseServiceData(data)
+	if err != nil {
+		reg.logger.Printf("error parsing service data %q: %s", zkPath, err)
+		// Keep the last known ones.
+		current := reg.catalog()
+		service = &serviceData{aliases: current.aliases[name], split: current.splits[name]}
+	}
+	if len(service.aliases) > 0 {
+		state.aliases[name] = service.aliases
+	}
+	if len(service.split) > 0 {
+		state.splits[name] = service.split
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package zkregistry
+
+import (
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// Make sure the reconciliation repairs the drift of the in-memory state.
+func TestReconcile(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	assertCreateTree(t, conn, "/test/discovery/name/version/addr1")
+	assertCreateTree(t, conn, "/test/discovery/name/version/addr2")
+
+	// Disable the periodic reconciliation, we trigger it manually.
+	reg, err := New(conn.conn, path.Join(conn.prefix, "/test/discovery"), discardLogger, WithTickInterval(0))
+	if err != nil {
+		t.Fatalf("Error creating new registry: %s", err)
+	}
+	defer func() { _ = reg.Close() }() // Best effort.
+	time.Sleep(100 * time.Millisecond)
+
+	// Simulate missed events.
+	reg.deleteEndpoint("name", "version", "addr1")
+	reg.add("name", "version", "ghost", Metadata{})
+	reg.setMetadata("name", "version", "addr2", Metadata{Zone: "stale"})
+	reg.add("gone", "version", "addr", Metadata{})
+	reg.add("name", "gone", "addr", Metadata{})
+
+	_ = reg.reconcile()
+
+	got, err := reg.Lookup("name", "version")
+	if err != nil {
+		t.Fatalf("Error looking up the registry: %s", err)
+	}
+	if expect := []string{"addr2", "addr1"}; !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected endpoints.\nExpect:\t%v\nGot:\t%v", expect, got)
+	}
+	instances, _ := reg.LookupInstances("name", "version")
+	if !reflect.DeepEqual(Metadata{}, instances[0].Metadata) {
+		t.Fatalf("Metadata should have been refreshed: %+v", instances[0].Metadata)
+	}
+	if _, err := reg.Lookup("gone", "version"); err != ErrServiceNotFound {
+		t.Fatalf("Unexpected error.\nExpect:\t%v\nGot:\t%v", ErrServiceNotFound, err)
+	}
+	if _, err := reg.Lookup("name", "gone"); err != ErrServiceNotFound {
+		t.Fatalf("Unexpected error.\nExpect:\t%v\nGot:\t%v", ErrServiceNotFound, err)
+	}
+
+	expect := Stats{
+		Reconciliations:  1,
+		ReconcileAdded:   1,
+		ReconcileRemoved: 3,
+		ReconcileUpdated: 1,
+	}
+	if got := reg.Stats(); expect != got {
+		t.Fatalf("Unexpected stats.\nExpect:\t%+v\nGot:\t%+v", expect, got)
+	}
+
+	// Nothing left to repair.
+	_ = reg.reconcile()
+	expect.Reconciliations++
+	if got := reg.Stats(); expect != got {
+		t.Fatalf("Unexpected stats.\nExpect:\t%+v\nGot:\t%+v", expect, got)
+	}
+}
+
+// Make sure the reconciliation leaves the local changes alone.
+func TestReconcileLocal(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	assertCreateTree(t, conn, "/test/discovery/name/version/addr1")
+	assertCreateTree(t, conn, "/test/discovery/name/version/addr2")
+
+	reg, err := New(conn.conn, path.Join(conn.prefix, "/test/discovery"), discardLogger, WithTickInterval(0))
+	if err != nil {
+		t.Fatalf("Error creating new registry: %s", err)
+	}
+	defer func() { _ = reg.Close() }() // Best effort.
+	time.Sleep(100 * time.Millisecond)
+
+	reg.DeleteEndpoint("name", "version", "addr1")
+	reg.Add("name", "version", "local")
+	reg.Add("local", "version", "addr")
+
+	_ = reg.reconcile()
+
+	if got, err := reg.Lookup("name", "version"); err != nil {
+		t.Fatalf("Error looking up the registry: %s", err)
+	} else if expect := []string{"addr2", "local"}; !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected endpoints.\nExpect:\t%v\nGot:\t%v", expect, got)
+	}
+	if got, err := reg.Lookup("local", "version"); err != nil {
+		t.Fatalf("Error looking up the registry: %s", err)
+	} else if expect := []string{"addr"}; !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected endpoints.\nExpect:\t%v\nGot:\t%v", expect, got)
+	}
+	if expect, got := (Stats{Reconciliations: 1}), reg.Stats(); expect != got {
+		t.Fatalf("Unexpected stats.\nExpect:\t%+v\nGot:\t%+v", expect, got)
+	}
+
+	// Once zookeeper reports a change, it wins again.
+	assertRemoveTree(t, conn, "/test/discovery/name/version/addr1")
+	assertCreateTree(t, conn, "/test/discovery/name/version/addr1")
+	time.Sleep(100 * time.Millisecond)
+	reg.deleteEndpoint("name", "version", "addr1")
+	_ = reg.reconcile()
+	if got, err := reg.Lookup("name", "version"); err != nil {
+		t.Fatalf("Error looking up the registry: %s", err)
+	} else if expect := []string{"addr2", "local", "addr1"}; !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected endpoints.\nExpect:\t%v\nGot:\t%v", expect, got)
+	}
+}
+
+// Make sure the reconciliation runs on each tick.
+func TestReconcileTick(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	assertCreateTree(t, conn, "/test/discovery/name/version/addr")
+
+	reg, err := New(conn.conn, path.Join(conn.prefix, "/test/discovery"), discardLogger, WithTickInterval(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Error creating new registry: %s", err)
+	}
+	defer func() { _ = reg.Close() }() // Best effort.
+	time.Sleep(100 * time.Millisecond)
+
+	// Simulate a missed event.
+	reg.deleteEndpoint("name", "version", "addr")
+
+	time.Sleep(200 * time.Millisecond)
+
+	if got, err := reg.Lookup("name", "version"); err != nil {
+		t.Fatalf("Error looking up the registry: %s", err)
+	} else if expect := []string{"addr"}; !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected endpoints.\nExpect:\t%v\nGot:\t%v", expect, got)
+	}
+	if stats := reg.Stats(); stats.Reconciliations == 0 || stats.ReconcileAdded != 1 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+}
+
+// Make sure the reconciliation aborts on unreadable nodes instead of dropping their endpoints.
+func TestReconcileReadError(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	assertCreateTree(t, conn, "/test/discovery/name/version/addr1")
+
+	reg, err := New(conn.conn, path.Join(conn.prefix, "/test/discovery"), discardLogger, WithTickInterval(0))
+	if err != nil {
+		t.Fatalf("Error creating new registry: %s", err)
+	}
+	defer func() { _ = reg.Close() }() // Best effort.
+	time.Sleep(100 * time.Millisecond)
+
+	// Revoke the read permission, SetACL does not trigger any watch.
+	if _, err := conn.conn.SetACL(path.Join(conn.prefix, "/test/discovery/name/version/addr1"), zk.WorldACL(zk.PermWrite|zk.PermDelete), -1); err != nil {
+		t.Fatalf("Error setting the acl: %s", err)
+	}
+
+	if err := reg.reconcile(); err == nil {
+		t.Fatal("Reconciliation should have failed")
+	}
+	assertLookupResult(t, &zkConn{ZKRegistry: reg}, "name", "version", []string{"addr1"}, nil)
+	if expect, got := (Stats{ReconcileErrors: 1}), reg.Stats(); expect != got {
+		t.Fatalf("Unexpected stats.\nExpect:\t%+v\nGot:\t%+v", expect, got)
+	}
+}
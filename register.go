@@ -0,0 +1,264 @@
+package zkregistry
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// registrationRetryDelay is the time to wait before retrying
+// to restore a registration after a zookeeper error.
+var registrationRetryDelay = 1 * time.Second
+
+// Registration is a handle on an endpoint published in zookeeper by the registry.
+// The endpoint node is ephemeral and gets re-created if it disappears
+// (i.e. after a session expiry) until Deregister is called.
+type Registration struct {
+	reg    *ZKRegistry
+	key    Key
+	target string // Path of the node to create, see layout.
+
+	// Node path, data and session id owning the node we created, used to not remove someone else's node.
+	// NOTE: the path differs from the target for sequential nodes.
+	lock  sync.Mutex
+	path  string
+	data  []byte
+	owner int64
+
+	// Internal controls.
+	once     sync.Once
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+// validatePathElem makes sure the given element can be used as a single zookeeper node name.
+func validatePathElem(kind, elem string) error {
+	if elem == "" || elem == "." || elem == ".." || strings.Contains(elem, "/") {
+		return fmt.Errorf("invalid %s: %q", kind, elem)
+	}
+	return nil
+}
+
+// Register publishes the given endpoint for the service name/version in zookeeper.
+// The parent nodes are created if needed and the endpoint is created as an ephemeral node.
+func (reg *ZKRegistry) Register(name, version, endpoint string) (*Registration, error) {
+	return reg.RegisterInstance(name, version, Instance{Address: endpoint})
+}
+
+// RegisterInstance publishes the given endpoint along with its metadata for the service name/version in zookeeper.
+// See Register.
+func (reg *ZKRegistry) RegisterInstance(name, version string, instance Instance) (*Registration, error) {
+	endpoint := instance.Address
+	if err := validatePathElem("service name", name); err != nil {
+		return nil, err
+	}
+	if err := validatePathElem("service version", version); err != nil {
+		return nil, err
+	}
+	if err := validatePathElem("endpoint", endpoint); err != nil {
+		return nil, err
+	}
+
+	key := Key{Name: name, Version: version, Endpoint: endpoint}
+	elems, err := reg.layout.Node(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(elems) != reg.layout.Depth() {
+		return nil, fmt.Errorf("invalid node path from layout: %q", elems)
+	}
+	for _, elem := range elems {
+		if err := validatePathElem("node path", elem); err != nil {
+			return nil, err
+		}
+	}
+	data, err := reg.layout.Encode(key, elems[len(elems)-1], instance.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-reg.stopChan:
+		return nil, ErrClosed
+	default:
+	}
+
+	// Make sure the parents exist.
+	if err := reg.createParents(elems[:len(elems)-1]); err != nil {
+		return nil, err
+	}
+
+	r := &Registration{
+		reg:      reg,
+		key:      key,
+		target:   reg.nodePath(elems),
+		path:     reg.nodePath(elems),
+		data:     data,
+		stopChan: make(chan struct{}),
+	}
+	// If the node already exists, it belongs to someone else (or to our previous session),
+	// keepalive will create it when it goes away.
+	if err := r.create(); err != nil && err != zk.ErrNodeExists {
+		return nil, fmt.Errorf("error creating %q: %s", r.target, err)
+	}
+
+	reg.regLock.Lock()
+	if reg.closed {
+		// Close already took its list of registrations, remove the node ourselves.
+		reg.regLock.Unlock()
+		_ = r.Deregister()
+		return nil, ErrClosed
+	}
+	reg.registrations[r] = struct{}{}
+	reg.regLock.Unlock()
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.keepalive()
+	}()
+
+	return r, nil
+}
+
+// Path returns the zookeeper path of the registered endpoint.
+func (r *Registration) Path() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.path
+}
+
+// SetMetadata updates the metadata of the registered endpoint.
+// The new metadata is kept for when the node gets re-created.
+func (r *Registration) SetMetadata(meta Metadata) error {
+	zkPath := r.Path()
+	data, err := r.reg.layout.Encode(r.key, path.Base(zkPath), meta)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	r.data = data
+	owner := r.owner
+	r.lock.Unlock()
+
+	ok, stat, err := r.reg.conn.Exists(zkPath)
+	if err != nil {
+		return fmt.Errorf("error looking up %q: %s", zkPath, err)
+	}
+	if !ok || stat.EphemeralOwner != owner {
+		// Not ours (yet), the data will be set on creation.
+		return nil
+	}
+	if _, err := r.reg.conn.Set(zkPath, data, stat.Version); err != nil {
+		return fmt.Errorf("error updating %q: %s", zkPath, err)
+	}
+	return nil
+}
+
+// create creates the ephemeral endpoint node and keeps track of its owner.
+func (r *Registration) create() error {
+	r.lock.Lock()
+	data := r.data
+	r.lock.Unlock()
+
+	created, err := r.reg.conn.Create(r.target, data, zk.FlagEphemeral|r.reg.layout.Flags(), r.reg.acls.level(r.reg.layout.Depth(), r.reg.layout))
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	r.path = created
+	r.lock.Unlock()
+
+	// Without the owner, the node could not be removed anymore, retry until we get it.
+	for {
+		ok, stat, err := r.reg.conn.Exists(created)
+		if err == nil {
+			if ok { // Otherwise, already gone with our session, keepalive re-creates it.
+				r.lock.Lock()
+				r.owner = stat.EphemeralOwner
+				r.lock.Unlock()
+			}
+			return nil
+		}
+		if err == zk.ErrClosing {
+			return err
+		}
+		r.reg.logger.Printf("error looking up the owner of %q: %s", created, err)
+		select {
+		case <-r.stopChan:
+			return err
+		case <-time.After(registrationRetryDelay):
+		}
+	}
+}
+
+// keepalive watches the endpoint node and re-creates it when it disappears.
+func (r *Registration) keepalive() {
+	for {
+		zkPath := r.Path()
+		ok, _, eventChan, err := r.reg.conn.ExistsW(zkPath)
+		if err == nil && !ok {
+			// The node is gone, re-create it and set a new watch.
+			if err = r.create(); err == nil || err == zk.ErrNodeExists {
+				continue
+			}
+		}
+		if err != nil {
+			r.reg.logger.Printf("error maintaining registration %q: %s", zkPath, err)
+			select {
+			case <-r.stopChan:
+				return
+			case <-time.After(registrationRetryDelay):
+			}
+			continue
+		}
+
+		// Wait for the node to change.
+		// NOTE: on session expiry, the watch gets invalidated and we loop.
+		select {
+		case <-r.stopChan:
+			return
+		case <-eventChan:
+		}
+	}
+}
+
+// Deregister removes the endpoint from zookeeper and stops maintaining it.
+// Subsequent calls are no-op.
+func (r *Registration) Deregister() error {
+	var err error
+	r.once.Do(func() {
+		close(r.stopChan)
+		r.wg.Wait()
+
+		r.lock.Lock()
+		owner := r.owner
+		r.lock.Unlock()
+
+		// Leave the node to the other registrations of the same endpoint.
+		if other := r.reg.release(r); other != nil {
+			other.adopt(owner)
+			return
+		}
+
+		// Only remove the node if we own it.
+		zkPath := r.Path()
+		ok, stat, e := r.reg.conn.Exists(zkPath)
+		if e != nil {
+			err = fmt.Errorf("error looking up %q: %s", zkPath, e)
+			return
+		}
+		if !ok || owner == 0 || stat.EphemeralOwner != owner {
+			return
+		}
+		if e := r.reg.conn.Delete(zkPath, stat.Version); e != nil && e != zk.ErrNoNode {
+			err = fmt.Errorf("error removing %q: %s", zkPath, e)
+		}
+	})
+	return err
+}
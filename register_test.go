@@ -0,0 +1,198 @@
+package zkregistry
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+func assertZKPathNotExist(t *testing.T, conn *zkConn, zkPath string) {
+	file, line := getCaller(t, 1)
+	if ok, _, err := conn.conn.Exists(zkPath); err != nil {
+		t.Fatalf("[%s:%d] Error looking up ZK path %q: %s", file, line, zkPath, err)
+	} else if ok {
+		t.Fatalf("[%s:%d] %q should not exist in zookeeper", file, line, zkPath)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	r, err := conn.Register("name", "version", "addr")
+	if err != nil {
+		t.Fatalf("Error registering endpoint: %s", err)
+	}
+	zkPath := path.Join(conn.prefix, "/discovery/name/version/addr")
+	if expect, got := zkPath, r.Path(); expect != got {
+		t.Fatalf("Unexpected path.\nExpect:\t%s\nGot:\t%s", expect, got)
+	}
+
+	// Make sure the node is ephemeral.
+	assertZKPathExist(t, conn, zkPath)
+	if _, stat, err := conn.conn.Exists(zkPath); err != nil {
+		t.Fatal(err)
+	} else if stat.EphemeralOwner == 0 {
+		t.Fatal("Registered endpoint should be an ephemeral node")
+	}
+
+	// Give time to ZK to signal the event.
+	time.Sleep(10 * time.Millisecond)
+
+	// Make sure the registry picked it up.
+	assertLookupResult(t, conn, "name", "version", []string{"addr"}, nil)
+
+	if err := r.Deregister(); err != nil {
+		t.Fatalf("Error deregistering endpoint: %s", err)
+	}
+	assertZKPathNotExist(t, conn, zkPath)
+
+	// Deregister should be idempotent.
+	if err := r.Deregister(); err != nil {
+		t.Fatalf("Error deregistering endpoint twice: %s", err)
+	}
+
+	// Give time to ZK to signal the event.
+	time.Sleep(10 * time.Millisecond)
+
+	assertLookupResult(t, conn, "name", "version", []string{}, nil)
+}
+
+// Make sure the endpoint gets re-created when it disappears.
+func TestRegisterRecreate(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	r, err := conn.Register("name", "version", "addr")
+	if err != nil {
+		t.Fatalf("Error registering endpoint: %s", err)
+	}
+	defer func() { _ = r.Deregister() }() // Best effort.
+
+	// Manually remove the node, as would a session expiry.
+	assertRemoveTree(t, conn, "/discovery/name/version/addr")
+
+	// Give time to the registration to restore the node.
+	time.Sleep(100 * time.Millisecond)
+
+	assertZKPathExist(t, conn, r.Path())
+}
+
+func TestRegisterClose(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	reg, err := New(conn.conn, path.Join(conn.prefix, "/test/discovery"), discardLogger)
+	if err != nil {
+		t.Fatalf("Error creating new registry: %s", err)
+	}
+	r, err := reg.Register("name", "version", "addr")
+	if err != nil {
+		t.Fatalf("Error registering endpoint: %s", err)
+	}
+	assertZKPathExist(t, conn, r.Path())
+
+	if err := reg.Close(); err != nil {
+		t.Fatalf("Error closing the registry: %s", err)
+	}
+	assertZKPathNotExist(t, conn, r.Path())
+
+	if _, err := reg.Register("name", "version", "addr"); err != ErrClosed {
+		t.Fatalf("Unexpected error.\nExpect:\t%v\nGot:\t%v", ErrClosed, err)
+	}
+}
+
+func TestRegisterCloseRace(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	reg, err := New(conn.conn, path.Join(conn.prefix, "/test/discovery"), discardLogger)
+	if err != nil {
+		t.Fatalf("Error creating new registry: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := reg.Register("name", "version", fmt.Sprintf("addr%d", i)); err != nil && err != ErrClosed {
+				t.Errorf("Error registering endpoint: %s", err)
+			}
+		}(i)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if err := reg.Close(); err != nil {
+		t.Fatalf("Error closing the registry: %s", err)
+	}
+	wg.Wait()
+
+	// Whichever side won, no endpoint should outlive the registry.
+	children, _, err := conn.conn.Children(path.Join(conn.prefix, "/test/discovery/name/version"))
+	if err != nil && err != zk.ErrNoNode {
+		t.Fatal(err)
+	}
+	if len(children) != 0 {
+		t.Fatalf("Endpoints left behind after Close: %v", children)
+	}
+}
+
+func TestRegisterInstance(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	r, err := conn.RegisterInstance("name", "version", Instance{Address: "addr", Metadata: Metadata{Weight: 5}})
+	if err != nil {
+		t.Fatalf("Error registering endpoint: %s", err)
+	}
+	defer func() { _ = r.Deregister() }() // Best effort.
+
+	// Give time to ZK to signal the event.
+	time.Sleep(10 * time.Millisecond)
+
+	expect := []Instance{{Address: "addr", Metadata: Metadata{Weight: 5}}}
+	if got, err := conn.LookupInstances("name", "version"); err != nil {
+		t.Fatalf("Error looking up instances: %s", err)
+	} else if !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected value.\nExpect:\t%+v\nGot:\t%+v", expect, got)
+	}
+
+	if err := r.SetMetadata(Metadata{Weight: 7, Zone: "a"}); err != nil {
+		t.Fatalf("Error updating metadata: %s", err)
+	}
+
+	// Give time to ZK to signal the event.
+	time.Sleep(10 * time.Millisecond)
+
+	expect = []Instance{{Address: "addr", Metadata: Metadata{Weight: 7, Zone: "a"}}}
+	if got, err := conn.LookupInstances("name", "version"); err != nil {
+		t.Fatalf("Error looking up instances: %s", err)
+	} else if !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected value.\nExpect:\t%+v\nGot:\t%+v", expect, got)
+	}
+}
+
+func TestRegisterInvalid(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	for _, elem := range []struct {
+		name, version, endpoint string
+	}{
+		{"", "version", "addr"},
+		{"name", "", "addr"},
+		{"name", "version", ""},
+		{"na/me", "version", "addr"},
+		{"name", "..", "addr"},
+		{"name", "version", "."},
+	} {
+		if _, err := conn.Register(elem.name, elem.version, elem.endpoint); err == nil {
+			t.Errorf("Registering %q/%q/%q should fail", elem.name, elem.version, elem.endpoint)
+		}
+	}
+}
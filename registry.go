@@ -6,8 +6,10 @@ import (
 	"fmt"
 	stdLog "log"
 	"os"
+	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/agrarianlabs/zkwatcher"
@@ -17,30 +19,82 @@ import (
 // ZKRegistry is an implementation of the registry with Zookeeper.
 type ZKRegistry struct {
 	// Underlying ZK connection.
-	conn   *zk.Conn
-	logger zk.Logger
+	conn    *zk.Conn
+	logger  zk.Logger
+	ownConn bool       // Whether Close closes conn, see Dial.
+	dial    dialConfig // Connection settings, see Dial.
+
+	sessionDone chan struct{} // Closed once the session follower is done, see Dial.
 
 	// Internal meta data.
-	offset       uint // offset of the original ZKPath used.
-	tickInterval time.Duration
+	root         string        // sanitized root path, with leading `/`.
+	offset       uint          // offset of the original ZKPath used.
+	tickInterval time.Duration // Full reconciliation interval, see WithTickInterval.
+	snapshotFile string        // On-disk cache, see WithSnapshotFile.
+	acls         ACLs          // ACLs of the created nodes, see WithACLs.
+	layout       Layout        // Tree layout, see WithLayout.
+	aclCheck     ACLCheck      // Startup ACL verification, see WithACLCheck.
 
 	// Internal controls.
 	stopChan chan struct{}
 	wg       sync.WaitGroup
 
+	// Runtime counters and health.
+	statsLock  sync.Mutex
+	stats      Stats
+	staleSince time.Time // Set while the watch is broken, see StaleSince.
+	lastEvent  time.Time // Last applied watcher event, see Health.
+	lastSync   time.Time // Last full sync with zookeeper, see Health.
+
 	// Registry state.
-	lock     sync.RWMutex
-	services map[string]map[string][]string
+	lock        sync.Mutex   // Serializes the changes, readers do not lock.
+	state       atomic.Value // Current *catalog.
+	trackOwners int32        // See SetOwnerTracking. Accessed atomically.
+
+	// Endpoints added (true) or removed (false) through Add/DeleteEndpoint, see reconcile. Protected by lock.
+	local map[endpointKey]bool
+
+	// Initial sync state. Only accessed from the watcher goroutine once started.
+	pending map[string]struct{} // Instance nodes from the initial listing not applied yet.
+	synced  chan struct{}       // Closed once pending is empty.
+	checked bool                // Set once the ACLs got verified, see WithACLCheck.
+
+	// Endpoints published by each instance node. Only accessed from the watcher goroutine once started.
+	nodes map[string][]Entry
+
+	// Outlier detection state.
+	outlierLock   sync.Mutex
+	outlierConfig OutlierDetection
+	outliers      map[endpointKey]*outlierState
+	ejected       atomic.Value // Current map[endpointKey]time.Time of the ejected endpoints.
+	ejectedChange atomic.Value // Current chan struct{}, closed when the ejected endpoints change.
+
+	// Locality-aware routing, see WithLocalityRouting.
+	locality LocalityRouting
+	cidrs    []cidrLocality // Parsed locality.CIDRs, the most specific first.
+
+	// Change subscribers.
+	subLock       sync.Mutex
+	subscriptions map[*Subscription]struct{}
+
+	// Endpoints published by the registry.
+	regLock       sync.Mutex
+	registrations map[*Registration]struct{}
+	closed        bool // Set by Close, refuses new registrations.
 }
 
 // Common errors.
 var (
 	ErrNilConn         = errors.New("can't create registry with <nil> zk connection")
 	ErrServiceNotFound = errors.New("service not found")
+	ErrClosed          = errors.New("registry closed")
+	ErrNoEndpoints     = errors.New("no endpoint available")
+	ErrInvalidLayout   = errors.New("invalid registry layout")
+	ErrNoSplit         = errors.New("no traffic split")
 )
 
 // New .
-func New(conn *zk.Conn, zkPath string, logger zk.Logger) (*ZKRegistry, error) {
+func New(conn *zk.Conn, zkPath string, logger zk.Logger, opts ...Option) (*ZKRegistry, error) {
 	if conn == nil {
 		return nil, ErrNilConn
 	}
@@ -48,91 +102,263 @@ func New(conn *zk.Conn, zkPath string, logger zk.Logger) (*ZKRegistry, error) {
 		logger = stdLog.New(os.Stderr, "", stdLog.LstdFlags)
 	}
 
-	// Make sure the path exists,
-	if err := createTree(conn, zkPath); err != nil {
-		return nil, err
-	}
-
 	reg := &ZKRegistry{
-		conn:         conn,
-		logger:       logger,
-		offset:       uint(len(strings.Split(sanitizePath(zkPath), "/"))),
-		services:     map[string]map[string][]string{},
-		stopChan:     make(chan struct{}),
-		tickInterval: 10 * time.Second,
+		conn:          conn,
+		logger:        logger,
+		root:          "/" + sanitizePath(zkPath),
+		offset:        uint(len(strings.Split(sanitizePath(zkPath), "/"))),
+		synced:        make(chan struct{}),
+		registrations: map[*Registration]struct{}{},
+		subscriptions: map[*Subscription]struct{}{},
+		outlierConfig: DefaultOutlierDetection,
+		outliers:      map[endpointKey]*outlierState{},
+		local:         map[endpointKey]bool{},
+		stopChan:      make(chan struct{}),
+		tickInterval:  10 * time.Second,
+		layout:        DefaultLayout,
+		nodes:         map[string][]Entry{},
 	}
-
-	if err := reg.startWatcher(zkPath); err != nil {
-		_ = reg.Close() // Best effort.
+	reg.state.Store(newCatalog())
+	reg.ejected.Store(map[endpointKey]time.Time{})
+	reg.ejectedChange.Store(make(chan struct{}))
+	for _, opt := range opts {
+		opt(reg)
+	}
+	if reg.layout == nil || reg.layout.Depth() < 1 {
+		return nil, ErrInvalidLayout
+	}
+	cidrs, err := parseCIDRs(reg.locality.CIDRs)
+	if err != nil {
 		return nil, err
 	}
+	reg.cidrs = cidrs
+
+	if err := reg.startWatcher(); err != nil {
+		if _, mismatch := err.(aclMismatchError); mismatch || reg.snapshotFile == "" || !reg.loadSnapshot() {
+			return nil, err
+		}
+		// Serve the last known state while catching up with zookeeper in background, see WithSnapshotFile.
+		reg.logger.Printf("error starting the registry, serving the snapshot: %s", err)
+		reg.start(nil)
+	}
 
 	return reg, nil
 }
 
+// watcher applies the events from the given zkwatcher until the registry is closed.
+// A nil zkwatcher starts with a rewatch.
 func (reg *ZKRegistry) watcher(watcher *zkwatcher.Watcher) {
-	ticker := time.NewTicker(reg.tickInterval)
-	defer ticker.Stop()
+	// The zkwatcher may be replaced, close whichever is current when done.
+	// NOTE: in background, closing blocks until the pending zookeeper calls return.
+	defer func() {
+		if w := watcher; w != nil {
+			go func() { _ = w.Close() }()
+		}
+	}()
+
+	var tickChan <-chan time.Time
+	if reg.tickInterval > 0 {
+		ticker := time.NewTicker(reg.tickInterval)
+		defer ticker.Stop()
+		tickChan = ticker.C
+	}
+
+	// Set until synced, independently of the reconciliation, see checkPending.
+	var pendingChan <-chan time.Time
+	if len(reg.pending) != 0 {
+		ticker := time.NewTicker(pendingCheckInterval)
+		defer ticker.Stop()
+		pendingChan = ticker.C
+	}
+
+	// Set while a rewatch is scheduled.
+	var rewatchChan <-chan time.Time
+	backoff := rewatchMinBackoff
+	var watchedAt time.Time // When the current watch got established.
+
+	var events <-chan zkwatcher.Event
+	resync := false // Set when events may have been dropped.
+	if watcher == nil {
+		rewatchChan = time.After(0)
+	} else {
+		events, watchedAt = watcher.C, time.Now()
+	}
 
 	for {
 		select {
 		case <-reg.stopChan:
 			return
-		case <-ticker.C:
-		case event := <-watcher.C:
-			name, version, endpoint, err := ParseConfigPath(event.Path, reg.offset)
+		case <-tickChan:
+			_ = reg.reconcile() // Errors are logged and counted.
+		case <-pendingChan:
+			if reg.checkPending(); len(reg.pending) == 0 {
+				pendingChan = nil
+			}
+		case <-rewatchChan:
+			rewatchChan = nil
+			w, err := reg.rewatch()
 			if err != nil {
-				reg.logger.Printf("error parsing the event from zookeeper: %s (%v)", err, event.Error)
-				break
+				reg.logger.Printf("error re-establishing the watch, retrying in %s: %s", backoff, err)
+				rewatchChan, backoff = time.After(backoff), nextBackoff(backoff)
+				continue
 			}
-			if event.Error != nil {
-				reg.logger.Printf("watch error from zookeeper for %s/%s: %s", name, version, event.Error)
-				break
+			if old := watcher; old != nil {
+				go func() { _ = old.Close() }()
 			}
-			// no error with empty name means the event is not for an endpoint, discard.
-			if name == "" {
-				break
+			watcher, events, watchedAt, resync = w, w.C, time.Now(), false
+
+			// The fresh listing got applied, nothing is pending anymore.
+			reg.pending = nil
+			reg.checkSynced()
+		case event := <-events:
+			// A full channel means the zkwatcher may discard events, resync once drained.
+			// NOTE: same as zkwatcher Stats Depth/Cap, without the locking.
+			if !resync && len(events)+1 >= cap(events) {
+				reg.suspectDrops()
+				resync = true
 			}
-			switch event.Type {
-			case zkwatcher.Create:
-				// If version or endpoint or nil, it is an event on parents. Discard.
-				if version != "" && endpoint != "" {
-					reg.Add(name, version, endpoint)
+			if !reg.handleEvent(event) && rewatchChan == nil {
+				var delay time.Duration
+				if delay, backoff = rewatchDelay(backoff, watchedAt); delay > 0 {
+					reg.logger.Printf("Watch broke shortly after being established, re-establishing in %s", delay)
 				}
-			case zkwatcher.Delete:
-				if version == "" {
-					reg.DeleteService(name)
-				} else if endpoint == "" {
-					reg.DeleteVersion(name, version)
-				} else {
-					reg.DeleteEndpoint(name, version, endpoint)
-				}
-			case zkwatcher.Update:
-				// We do not use the value, discard Update events.
+				rewatchChan = time.After(delay)
+			}
+			if resync && len(events) == 0 {
+				reg.logger.Printf("Watcher channel drained, resyncing")
+				resync = reg.reconcile() != nil // Retry on next event if failed.
 			}
 		}
 	}
 }
 
-func (reg *ZKRegistry) startWatcher(zkPath string) error {
+// handleEvent applies the given watcher event to the registry state.
+// Returns false if the event reports a broken watch.
+func (reg *ZKRegistry) handleEvent(event zkwatcher.Event) bool {
+	var key Key
+	elems, err := reg.relative(event.Path)
+	if err == nil {
+		key, err = reg.parse(elems)
+	}
+	if err != nil {
+		reg.logger.Printf("error parsing the event from zookeeper: %s (%v)", err, event.Error)
+		return true
+	}
+	// The node is gone before its watch got set, the zkwatcher won't report its removal.
+	// Also reported right after a removal, unless the node got re-created in the meantime.
+	gone := event.Error == zk.ErrNoNode && len(elems) > 0
+	if gone {
+		event.Type = zkwatcher.Delete
+	} else if event.Error != nil {
+		reg.logger.Printf("watch error from zookeeper for %s/%s: %s", key.Name, key.Version, event.Error)
+		reg.markStale()
+		return false
+	}
+	reg.touch(&reg.lastEvent)
+	// no error on the root itself, discard.
+	if len(elems) == 0 {
+		return true
+	}
+	// Only the instance nodes carry endpoints, the others are parents.
+	// The service nodes carry the aliases and the traffic split.
+	instance := len(elems) == reg.layout.Depth()
+	service := !instance && reg.isServiceNode(elems, key)
+	switch event.Type {
+	case zkwatcher.Create:
+		if instance {
+			reg.refreshNode(event.Path, key)
+			reg.resolvePending(event.Path)
+		} else if service {
+			reg.readServiceNode(event.Path, key.Name)
+		}
+	case zkwatcher.Delete:
+		if !instance {
+			reg.removeParent(event.Path, key)
+		} else if gone || !reg.ownerTracking() {
+			reg.removeNode(event.Path)
+		} else {
+			// Possibly re-created in the meantime, the watcher won't report its new data.
+			reg.refreshNode(event.Path, key)
+		}
+		reg.resolvePending(event.Path)
+	case zkwatcher.Update:
+		// Discard Update events on the other parents and on nodes not applied yet.
+		if _, ok := reg.nodes[event.Path]; instance && ok {
+			reg.refreshNode(event.Path, key)
+		} else if service {
+			reg.readServiceNode(event.Path, key.Name)
+		}
+	}
+	return true
+}
+
+// startWatcher prepares the registry tree, lists the existing endpoints and starts watching them.
+func (reg *ZKRegistry) startWatcher() error {
+	// Make sure the path exists,
+	if err := reg.createParents(nil); err != nil {
+		return err
+	}
+	// and is protected as expected.
+	if err := reg.verifyACLs(); err != nil {
+		return err
+	}
+	reg.checked = true
+
+	// List the existing endpoints so we know when the watcher is done with the initial walk.
+	if err := reg.initPending(); err != nil {
+		return err
+	}
+
 	watcher := zkwatcher.NewWatcher(reg.conn)
-	if err := watcher.WatchLimit(zkPath, 2); err != nil {
+	if err := watcher.WatchLimit(reg.root, reg.layout.Depth()-1); err != nil {
+		_ = watcher.Close() // Best effort.
 		return err
 	}
+	reg.start(watcher)
+	return nil
+}
+
+// start runs the background goroutines, see watcher.
+func (reg *ZKRegistry) start(watcher *zkwatcher.Watcher) {
 	reg.wg.Add(1)
 	go func() {
 		defer reg.wg.Done()
 		reg.watcher(watcher)
 	}()
 
-	return nil
+	if reg.snapshotFile != "" {
+		reg.wg.Add(1)
+		go func() {
+			defer reg.wg.Done()
+			reg.snapshotWriter()
+		}()
+	}
 }
 
-// Close terminates the registry.
+// Close terminates the registry and removes the endpoints it registered.
 func (reg *ZKRegistry) Close() error {
+	reg.regLock.Lock()
+	reg.closed = true
+	registrations := make([]*Registration, 0, len(reg.registrations))
+	for r := range reg.registrations {
+		registrations = append(registrations, r)
+	}
+	reg.regLock.Unlock()
+
+	var err error
+	for _, r := range registrations {
+		if e := r.Deregister(); e != nil && err == nil {
+			err = e
+		}
+	}
+
 	close(reg.stopChan)
 	reg.wg.Wait()
-	return nil
+	if reg.ownConn {
+		reg.conn.Close()
+		<-reg.sessionDone
+	}
+	return err
 }
 
 // SetLogger overrides the default logger.
@@ -143,95 +369,201 @@ func (reg *ZKRegistry) SetLogger(logger zk.Logger) *ZKRegistry {
 }
 
 // String returns the json representation of the registered services.
-// NOTE: induces a lock. You should not let users call this.
+// NOTE: You should not let users call this.
 func (reg *ZKRegistry) String() string {
-	var ret string
-	reg.lock.RLock()
-	buf, err := json.Marshal(reg.services)
-	if err != nil {
-		ret = fmt.Sprintln(reg.services)
+	services := map[string]map[string][]string{}
+	for name, versions := range reg.catalog().services {
+		services[name] = make(map[string][]string, len(versions))
+		for version, list := range versions {
+			services[name][version] = list.endpoints
+		}
 	}
-	reg.lock.RUnlock()
-	if err == nil {
-		ret = string(buf)
+	buf, err := json.Marshal(services)
+	if err != nil {
+		return fmt.Sprintln(services)
 	}
-	return ret
+	return string(buf)
 }
 
 /// registry.Registry implementation.
 
 // Lookup return the endpoint list for the given service name/version.
+// The version can be an alias, see SetAliases.
+// Ejected endpoints are excluded, see Failure.
+// Lookup does not lock, the returned slice is never modified by the registry
+// and can be kept forever. It must not be modified by the caller.
 func (reg *ZKRegistry) Lookup(name, version string) ([]string, error) {
-	reg.lock.RLock()
-	targets, ok := reg.services[name][version]
-	reg.lock.RUnlock()
+	current := reg.catalog()
+	version = current.resolve(name, version)
+	list, ok := current.lookup(name, version)
 	if !ok {
 		return nil, ErrServiceNotFound
 	}
-	return targets, nil
+	return reg.filterEjected(name, version, list).endpoints, nil
 }
 
-// Failure marks the given endpoint for service name/version as failed.
-func (reg *ZKRegistry) Failure(name, version, endpoint string, err error) {
-	// Would be used to remove an endpoint from the rotation, log the failure, etc.
-	reg.logger.Printf("Error accessing %s/%s (%s): %s", name, version, endpoint, err)
+// LookupInstances returns the endpoint list along with their metadata for the given service name/version.
+// Ejected endpoints are excluded, see Failure.
+// As for Lookup, the returned slice must not be modified.
+func (reg *ZKRegistry) LookupInstances(name, version string) ([]Instance, error) {
+	current := reg.catalog()
+	version = current.resolve(name, version)
+	list, ok := current.lookup(name, version)
+	if !ok {
+		return nil, ErrServiceNotFound
+	}
+	return reg.filterEjected(name, version, list).instances, nil
 }
 
 // Add adds the given endpoit for the service name/version.
+// The endpoint is local to the registry: the reconciliation leaves it alone
+// until zookeeper reports a change for it.
 func (reg *ZKRegistry) Add(name, version, endpoint string) {
+	reg.setLocal(name, version, endpoint, true)
+	reg.add(name, version, endpoint, Metadata{})
+}
+
+// add adds the given endpoint with its metadata for the service name/version.
+// Endpoints are a set keyed by address: adding a known endpoint only refreshes its metadata.
+func (reg *ZKRegistry) add(name, version, endpoint string, meta Metadata) {
 	reg.lock.Lock()
 
-	service, ok := reg.services[name]
-	if !ok {
-		service = map[string][]string{}
-		reg.services[name] = service
+	current := reg.catalog()
+	var instances []Instance
+	if list, ok := current.lookup(name, version); ok {
+		for i, instance := range list.instances {
+			if instance.Address != endpoint {
+				continue
+			}
+			if reflect.DeepEqual(instance.Metadata, meta) {
+				// Already known, nothing to do.
+				reg.lock.Unlock()
+				return
+			}
+			instances = make([]Instance, len(list.instances))
+			copy(instances, list.instances)
+			instances[i].Metadata = meta
+			break
+		}
+		if instances == nil {
+			instances = make([]Instance, len(list.instances), len(list.instances)+1)
+			copy(instances, list.instances)
+			instances = append(instances, Instance{Address: endpoint, Metadata: meta})
+		}
+	} else {
+		instances = []Instance{{Address: endpoint, Metadata: meta}}
 	}
-	service[version] = append(service[version], endpoint)
+	reg.commitLocked(current.withVersion(name, version, newEndpointList(instances)))
 
 	reg.lock.Unlock()
+
+	reg.publish(name, version)
+}
+
+// setMetadata refreshes the metadata of the given endpoint.
+// No-op if the endpoint is not known.
+func (reg *ZKRegistry) setMetadata(name, version, endpoint string, meta Metadata) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	current := reg.catalog()
+	list, ok := current.lookup(name, version)
+	if !ok {
+		return
+	}
+	var instances []Instance
+	for i, instance := range list.instances {
+		if instance.Address != endpoint {
+			continue
+		}
+		if instances == nil {
+			instances = make([]Instance, len(list.instances))
+			copy(instances, list.instances)
+		}
+		instances[i].Metadata = meta
+	}
+	if instances == nil {
+		return
+	}
+	reg.commitLocked(current.withVersion(name, version, newEndpointList(instances)))
 }
 
 // DeleteEndpoint removes the given endpoit for the service name/version.
+// As for Add, the removal is local: the reconciliation does not bring the endpoint
+// back until zookeeper reports a change for it.
 func (reg *ZKRegistry) DeleteEndpoint(name, version, endpoint string) {
+	reg.setLocal(name, version, endpoint, false)
+	reg.deleteEndpoint(name, version, endpoint)
+}
+
+// deleteEndpoint removes the given endpoint for the service name/version.
+func (reg *ZKRegistry) deleteEndpoint(name, version, endpoint string) {
 	reg.lock.Lock()
 
-	service, ok := reg.services[name]
+	current := reg.catalog()
+	list, ok := current.lookup(name, version)
 	if !ok {
 		reg.lock.Unlock()
 		return
 	}
-begin:
-	for i, svc := range service[version] {
-		if svc == endpoint {
-			copy(service[version][i:], service[version][i+1:])
-			service[version][len(service[version])-1] = ""
-			service[version] = service[version][:len(service[version])-1]
-			goto begin
+	instances := make([]Instance, 0, len(list.instances))
+	for _, instance := range list.instances {
+		if instance.Address != endpoint {
+			instances = append(instances, instance)
 		}
 	}
+	if len(instances) == len(list.instances) {
+		// Not known, nothing to do.
+		reg.lock.Unlock()
+		return
+	}
+	reg.commitLocked(current.withVersion(name, version, newEndpointList(instances)))
 
 	reg.lock.Unlock()
+
+	reg.publish(name, version)
+	reg.forgetOutliers(name, version, endpoint)
 }
 
 // DeleteVersion removes the given version for the service name.
 func (reg *ZKRegistry) DeleteVersion(name, version string) {
 	reg.lock.Lock()
 
-	service, ok := reg.services[name]
-	if !ok {
+	current := reg.catalog()
+	if _, ok := current.lookup(name, version); !ok {
 		reg.lock.Unlock()
 		return
 	}
-	delete(service, version)
+	reg.commitLocked(current.withVersion(name, version, nil))
+	reg.forgetLocalLocked(name, version)
 
 	reg.lock.Unlock()
+
+	reg.publish(name, version)
+	reg.forgetOutliers(name, version, "")
 }
 
 // DeleteService removes the given service.
 func (reg *ZKRegistry) DeleteService(name string) {
 	reg.lock.Lock()
 
-	delete(reg.services, name)
+	current := reg.catalog()
+	service, ok := current.services[name]
+	if !ok {
+		reg.lock.Unlock()
+		return
+	}
+	versions := make([]string, 0, len(service))
+	for version := range service {
+		versions = append(versions, version)
+	}
+	reg.commitLocked(current.withoutService(name))
+	reg.forgetLocalLocked(name, "")
 
 	reg.lock.Unlock()
+
+	for _, version := range versions {
+		reg.publish(name, version)
+	}
+	reg.forgetOutliers(name, "", "")
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"log"
 	"path"
+	"reflect"
 	"testing"
 	"time"
 
@@ -59,7 +60,19 @@ func TestAddEndpoint(t *testing.T) {
 	// Make sure the registry picked it up.
 	assertLookupResult(t, conn, "name", "version", []string{"addr"}, nil)
 
-	// TODO: test to add a 2nd then a 3rd with same name/version/addr
+	// Adding the same endpoint again is a no-op.
+	revision := conn.Snapshot().Revision()
+	conn.Add("name", "version", "addr")
+	conn.Add("name", "version", "addr")
+	assertLookupResult(t, conn, "name", "version", []string{"addr"}, nil)
+	if expect, got := revision, conn.Snapshot().Revision(); expect != got {
+		t.Fatalf("Unexpected revision.\nExpect:\t%d\nGot:\t%d", expect, got)
+	}
+
+	// A single removal is enough.
+	conn.Add("name", "version", "addr2")
+	conn.DeleteEndpoint("name", "version", "addr")
+	assertLookupResult(t, conn, "name", "version", []string{"addr2"}, nil)
 }
 
 // TODO: check the watcher's stats for goroutines.
@@ -88,10 +101,7 @@ func TestDeleteEndpoint(t *testing.T) {
 	assertLookupResult(t, conn, "name", "version", []string{}, nil)
 
 	// Manually check the state of the registry as well.
-	conn.ZKRegistry.lock.RLock()
-	defer conn.ZKRegistry.lock.RUnlock()
-
-	service, ok := conn.ZKRegistry.services["name"]
+	service, ok := conn.ZKRegistry.catalog().services["name"]
 	if !ok {
 		t.Fatal("services map should not be empty after removing an endpoint")
 	}
@@ -99,7 +109,7 @@ func TestDeleteEndpoint(t *testing.T) {
 	if !ok {
 		t.Fatal("version map should not be empty after removing an endpoint")
 	}
-	for _, endpoint := range version {
+	for _, endpoint := range version.endpoints {
 		if endpoint == "addr" {
 			t.Fatal("The endpoint should not be present after removing it")
 		}
@@ -133,10 +143,7 @@ func TestDeleteVersion(t *testing.T) {
 	assertLookupResult(t, conn, "name", "version", nil, ErrServiceNotFound)
 
 	// Manually check the state of the registry as well.
-	conn.ZKRegistry.lock.RLock()
-	defer conn.ZKRegistry.lock.RUnlock()
-
-	service, ok := conn.ZKRegistry.services["name"]
+	service, ok := conn.ZKRegistry.catalog().services["name"]
 	if !ok {
 		t.Fatal("services map should not be empty after removing just the version")
 	}
@@ -172,10 +179,7 @@ func TestDeleteService(t *testing.T) {
 	assertLookupResult(t, conn, "name", "version", nil, ErrServiceNotFound)
 
 	// Manually check the state of the registry as well.
-	conn.ZKRegistry.lock.RLock()
-	defer conn.ZKRegistry.lock.RUnlock()
-
-	if _, ok := conn.ZKRegistry.services["name"]; ok {
+	if _, ok := conn.ZKRegistry.catalog().services["name"]; ok {
 		t.Fatal("services map should be empty after removing the service")
 	}
 }
@@ -258,6 +262,48 @@ func TestRegStringer(t *testing.T) {
 	}
 }
 
+func TestLookupInstances(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	// Manually register a new service in ZK with metadata.
+	assertCreateTree(t, conn, "/discovery/name/version")
+	zkPath := path.Join(conn.prefix, "/discovery/name/version/addr")
+	if _, err := conn.conn.Create(zkPath, []byte(`{"weight":10,"zone":"a"}`), 0, zk.WorldACL(zk.PermAll)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Give time to ZK to signal the event.
+	time.Sleep(10 * time.Millisecond)
+
+	expect := []Instance{{Address: "addr", Metadata: Metadata{Weight: 10, Zone: "a"}}}
+	if got, err := conn.LookupInstances("name", "version"); err != nil {
+		t.Fatalf("Error looking up instances: %s", err)
+	} else if !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected value.\nExpect:\t%+v\nGot:\t%+v", expect, got)
+	}
+
+	// Update the data, the metadata should be refreshed in place.
+	if _, err := conn.conn.Set(zkPath, []byte(`{"weight":20,"zone":"b"}`), -1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Give time to ZK to signal the event.
+	time.Sleep(10 * time.Millisecond)
+
+	expect = []Instance{{Address: "addr", Metadata: Metadata{Weight: 20, Zone: "b"}}}
+	if got, err := conn.LookupInstances("name", "version"); err != nil {
+		t.Fatalf("Error looking up instances: %s", err)
+	} else if !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected value.\nExpect:\t%+v\nGot:\t%+v", expect, got)
+	}
+	assertLookupResult(t, conn, "name", "version", []string{"addr"}, nil)
+
+	if _, err := conn.LookupInstances("name", "unknown"); err != ErrServiceNotFound {
+		t.Fatalf("Unexpected error.\nExpect:\t%v\nGot:\t%v", ErrServiceNotFound, err)
+	}
+}
+
 func TestFailure(t *testing.T) {
 	buf := bytes.NewBuffer(nil)
 	logger := log.New(buf, "", 0)
@@ -0,0 +1,97 @@
+package zkregistry
+
+import (
+	"time"
+
+	"github.com/agrarianlabs/zkwatcher"
+)
+
+// Backoff bounds between the attempts to re-establish a broken watch.
+// The backoff only resets once a re-established watch stayed up for rewatchHealthyPeriod.
+var (
+	rewatchMinBackoff    = 100 * time.Millisecond
+	rewatchMaxBackoff    = 30 * time.Second
+	rewatchHealthyPeriod = 1 * time.Minute
+)
+
+// nextBackoff returns the backoff to use after the given one, up to rewatchMaxBackoff.
+func nextBackoff(backoff time.Duration) time.Duration {
+	if backoff *= 2; backoff > rewatchMaxBackoff {
+		return rewatchMaxBackoff
+	}
+	return backoff
+}
+
+// rewatchDelay returns the delay before re-establishing a watch broken after being up since the given time,
+// along with the backoff to use next.
+// A watch breaking right away again and again (i.e. persistent ErrNoAuth on a node) keeps backing off.
+func rewatchDelay(backoff time.Duration, watchedAt time.Time) (time.Duration, time.Duration) {
+	if time.Since(watchedAt) >= rewatchHealthyPeriod {
+		return 0, rewatchMinBackoff
+	}
+	return backoff, nextBackoff(backoff)
+}
+
+// StaleSince returns the time since which the registry state may be outdated,
+// i.e. the zookeeper watch broke after a session expiry or a connection error
+// and has not been re-established yet.
+// Returns the zero time when the registry is up to date.
+func (reg *ZKRegistry) StaleSince() time.Time {
+	reg.statsLock.Lock()
+	defer reg.statsLock.Unlock()
+	return reg.staleSince
+}
+
+// markStale counts a watch error and flags the state as stale.
+func (reg *ZKRegistry) markStale() {
+	reg.statsLock.Lock()
+	reg.stats.WatchErrors++
+	if reg.staleSince.IsZero() {
+		reg.staleSince = time.Now()
+	}
+	reg.statsLock.Unlock()
+}
+
+// suspectDrops counts a watcher channel overflow.
+func (reg *ZKRegistry) suspectDrops() {
+	reg.statsLock.Lock()
+	reg.stats.SuspectedDrops++
+	reg.statsLock.Unlock()
+	reg.logger.Printf("Watcher channel full, events may be dropped: the registry consumer is too slow")
+}
+
+// rewatch sets a new recursive watch and rebuilds the state from a fresh listing.
+// The stale flag is cleared on success.
+// NOTE: expected to be called from the watcher goroutine.
+func (reg *ZKRegistry) rewatch() (*zkwatcher.Watcher, error) {
+	// The root may not exist yet after a degraded start.
+	if err := reg.createParents(nil); err != nil {
+		return nil, err
+	}
+	// Nor the ACLs be verified. On mismatch, keep serving the snapshot.
+	if !reg.checked {
+		if err := reg.verifyACLs(); err != nil {
+			return nil, err
+		}
+		reg.checked = true
+	}
+	watcher := zkwatcher.NewWatcher(reg.conn)
+	if err := watcher.WatchLimit(reg.root, reg.layout.Depth()-1); err != nil {
+		_ = watcher.Close() // Best effort.
+		return nil, err
+	}
+	// The new watch only reports what it finds, apply what we missed in the meantime.
+	if err := reg.reconcile(); err != nil {
+		go func() { _ = watcher.Close() }()
+		return nil, err
+	}
+
+	reg.statsLock.Lock()
+	reg.stats.Rewatches++
+	if !reg.staleSince.IsZero() {
+		reg.logger.Printf("Watch re-established, the registry was stale for %s", time.Since(reg.staleSince))
+	}
+	reg.staleSince = time.Time{}
+	reg.statsLock.Unlock()
+	return watcher, nil
+}
@@ -0,0 +1,174 @@
+package zkregistry
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/agrarianlabs/zkwatcher"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// Make sure a watch error flags the registry as stale until the watch gets re-established.
+func TestRewatchStale(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	if !conn.StaleSince().IsZero() {
+		t.Fatal("A new registry should not be stale")
+	}
+
+	// Simulate a broken watch.
+	zkPath := path.Join(conn.root, "name", "version")
+	if conn.handleEvent(zkwatcher.Event{Path: zkPath, Error: errors.New("fail")}) {
+		t.Fatal("A watch error should be reported as a broken watch")
+	}
+	if conn.StaleSince().IsZero() {
+		t.Fatal("The registry should be stale after a watch error")
+	}
+
+	// A missing node is not a broken watch.
+	if !conn.handleEvent(zkwatcher.Event{Path: path.Join(zkPath, "addr"), Error: zk.ErrNoNode}) {
+		t.Fatal("A missing node should not be reported as a broken watch")
+	}
+
+	w, err := conn.rewatch()
+	if err != nil {
+		t.Fatalf("Error re-establishing the watch: %s", err)
+	}
+	_ = w.Close() // Best effort.
+	if !conn.StaleSince().IsZero() {
+		t.Fatal("The registry should not be stale after a rewatch")
+	}
+	if stats := conn.Stats(); stats.WatchErrors != 1 || stats.Rewatches != 1 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+}
+
+// Make sure the registry recovers from a session expiry.
+func TestRewatchSessionExpiry(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	assertCreateTree(t, conn, "/test/discovery/name/version/addr1")
+
+	// Connect through a proxy so we can cut the connection.
+	p := newTCPProxy(t, testZKHost)
+	p.Start()
+	defer p.Stop()
+	proxyConn, _, err := zk.Connect([]string{p.URL}, 1*time.Second)
+	if err != nil {
+		t.Fatalf("Unable to connect to ZK: %s", err)
+	}
+	defer proxyConn.Close()
+	proxyConn.SetLogger(discardLogger)
+
+	// Disable the periodic reconciliation, only the rewatch can repair the state.
+	reg, err := New(proxyConn, path.Join(conn.prefix, "/test/discovery"), discardLogger, WithTickInterval(0))
+	if err != nil {
+		t.Fatalf("Error creating new registry: %s", err)
+	}
+	defer func() { _ = reg.Close() }() // Best effort.
+	time.Sleep(100 * time.Millisecond)
+
+	if got, err := reg.Lookup("name", "version"); err != nil {
+		t.Fatalf("Error looking up the registry: %s", err)
+	} else if expect := []string{"addr1"}; !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected endpoints.\nExpect:\t%v\nGot:\t%v", expect, got)
+	}
+
+	// Cut the connection long enough for the session to expire and change the tree meanwhile.
+	p.Stop()
+	assertCreateTree(t, conn, "/test/discovery/name/version/addr2")
+	assertRemoveTree(t, conn, "/test/discovery/name/version/addr1")
+	time.Sleep(3 * time.Second)
+	p.Start()
+
+	expect := []string{"addr2"}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, _ := reg.Lookup("name", "version")
+		if reflect.DeepEqual(expect, got) && reg.StaleSince().IsZero() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Registry did not recover.\nExpect:\t%v\nGot:\t%v (stale since %s)", expect, got, reg.StaleSince())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if stats := reg.Stats(); stats.WatchErrors == 0 || stats.Rewatches == 0 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+
+	// The new watch is live.
+	assertCreateTree(t, conn, "/test/discovery/name/version/addr3")
+	time.Sleep(100 * time.Millisecond)
+	if got, _ := reg.Lookup("name", "version"); !reflect.DeepEqual([]string{"addr2", "addr3"}, got) {
+		t.Fatalf("Unexpected endpoints after the rewatch: %v", got)
+	}
+}
+
+// Make sure a full watcher channel triggers a resync.
+func TestSuspectedDrops(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	assertCreateTree(t, conn, "/discovery/name/version")
+	time.Sleep(100 * time.Millisecond)
+	reconciliations := conn.Stats().Reconciliations
+
+	// Block the consumer while flooding the watcher channel.
+	const n = 1100
+	conn.ZKRegistry.lock.Lock()
+	for i := 0; i < n; i++ {
+		assertCreateTree(t, conn, fmt.Sprintf("/discovery/name/version/addr%d", i))
+	}
+	// Give time to the watcher to report the events.
+	time.Sleep(500 * time.Millisecond)
+	conn.ZKRegistry.lock.Unlock()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		endpoints, _ := conn.Lookup("name", "version")
+		stats := conn.Stats()
+		if len(endpoints) == n && stats.SuspectedDrops == 1 && stats.Reconciliations > reconciliations {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Registry did not resync: %d endpoints, %+v", len(endpoints), stats)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if h := conn.Health(); h.SuspectedDrops != 1 {
+		t.Fatalf("Unexpected health: %+v", h)
+	}
+}
+
+// Make sure a watch breaking right after being re-established keeps backing off.
+func TestRewatchDelay(t *testing.T) {
+	backoff := rewatchMinBackoff
+
+	// A watch broken right away waits for the backoff, which grows up to the max.
+	for i := 0; i < 20; i++ {
+		delay, next := rewatchDelay(backoff, time.Now())
+		if delay != backoff {
+			t.Fatalf("Unexpected delay.\nExpect:\t%s\nGot:\t%s", backoff, delay)
+		}
+		if next < backoff || next > rewatchMaxBackoff {
+			t.Fatalf("Unexpected next backoff after %s: %s", backoff, next)
+		}
+		backoff = next
+	}
+	if backoff != rewatchMaxBackoff {
+		t.Fatalf("Unexpected backoff.\nExpect:\t%s\nGot:\t%s", rewatchMaxBackoff, backoff)
+	}
+
+	// A watch broken after a healthy period is re-established right away, the backoff resets.
+	delay, next := rewatchDelay(backoff, time.Now().Add(-rewatchHealthyPeriod))
+	if delay != 0 || next != rewatchMinBackoff {
+		t.Fatalf("Unexpected delay/backoff after a healthy watch: %s/%s", delay, next)
+	}
+}
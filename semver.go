@@ -0,0 +1,418 @@
+package zkregistry
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RangeFlag tunes the resolution of the version constraints, see LookupRange.
+type RangeFlag int
+
+// RangeFlag values, to be combined with |.
+const (
+	RangeMerge      RangeFlag = 1 << iota // Merge the endpoints of all the matching versions instead of using the highest one.
+	RangePrerelease                       // Include the pre-release versions, i.e. 1.2.0-beta.1.
+)
+
+// semver is a parsed semantic version, see http://semver.org.
+// The build metadata is ignored.
+type semver struct {
+	major, minor, patch int
+	pre                 []string // Pre-release identifiers, nil for releases.
+}
+
+// parseSemver parses the given version, with an optional "v" prefix, i.e. v1.4.2 or 1.4.2-rc.1+build.5.
+// Missing minor and patch numbers default to 0 so the usual v1, v2 version names are supported.
+func parseSemver(s string) (semver, error) {
+	v, n, err := parsePartial(s)
+	if err != nil {
+		return semver{}, err
+	}
+	core := s
+	if i := strings.IndexAny(core, "-+"); i >= 0 {
+		core = core[:i]
+	}
+	if n < 0 || strings.ContainsAny(core, "xX*") {
+		return semver{}, fmt.Errorf("invalid version: %q", s)
+	}
+	return v, nil
+}
+
+// parsePartial parses the given version, possibly partial or with wildcards, i.e. 1.x or 1.2.*.
+// Returns the version along with the number of specified numbers, -1 for versions without numbers.
+func parsePartial(s string) (semver, int, error) {
+	var v semver
+	str := strings.TrimPrefix(s, "v")
+	if i := strings.IndexByte(str, '+'); i >= 0 {
+		str = str[:i]
+	}
+	if i := strings.IndexByte(str, '-'); i >= 0 {
+		for _, id := range strings.Split(str[i+1:], ".") {
+			if id == "" {
+				return semver{}, 0, fmt.Errorf("invalid pre-release in version: %q", s)
+			}
+		}
+		v.pre = strings.Split(str[i+1:], ".")
+		str = str[:i]
+	}
+
+	parts := strings.Split(str, ".")
+	if len(parts) > 3 {
+		return semver{}, 0, fmt.Errorf("invalid version: %q", s)
+	}
+	nums := [3]*int{&v.major, &v.minor, &v.patch}
+	n := -1
+	for i, part := range parts {
+		if part == "x" || part == "X" || part == "*" {
+			break
+		}
+		num, err := strconv.Atoi(part)
+		if err != nil || num < 0 {
+			return semver{}, 0, fmt.Errorf("invalid version: %q", s)
+		}
+		*nums[i] = num
+		n = i + 1
+	}
+	if n < 3 && v.pre != nil {
+		return semver{}, 0, fmt.Errorf("invalid version: %q", s)
+	}
+	return v, n, nil
+}
+
+// compare returns -1, 0 or 1 if the version is lower, equal or greater than the given one.
+func (v semver) compare(o semver) int {
+	for _, c := range [][2]int{{v.major, o.major}, {v.minor, o.minor}, {v.patch, o.patch}} {
+		if c[0] != c[1] {
+			return sign(c[0] - c[1])
+		}
+	}
+	switch {
+	case v.pre == nil && o.pre == nil:
+		return 0
+	case v.pre == nil:
+		return 1
+	case o.pre == nil:
+		return -1
+	}
+	for i := 0; i < len(v.pre) && i < len(o.pre); i++ {
+		if c := comparePrerelease(v.pre[i], o.pre[i]); c != 0 {
+			return c
+		}
+	}
+	return sign(len(v.pre) - len(o.pre))
+}
+
+// comparePrerelease compares pre-release identifiers: numerically for numbers,
+// lexically otherwise, the numbers being lower than the others.
+func comparePrerelease(a, b string) int {
+	na, errA := strconv.Atoi(a)
+	nb, errB := strconv.Atoi(b)
+	switch {
+	case errA == nil && errB == nil:
+		return sign(na - nb)
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	default:
+		return strings.Compare(a, b)
+	}
+}
+
+func sign(i int) int {
+	switch {
+	case i < 0:
+		return -1
+	case i > 0:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// bump returns the lowest version above the versions starting with the first n numbers of the given one,
+// i.e. 1.3.0-0 for 1.2 (n = 2).
+func (v semver) bump(n int) semver {
+	switch n {
+	case 1:
+		return semver{major: v.major + 1, pre: []string{"0"}}
+	case 2:
+		return semver{major: v.major, minor: v.minor + 1, pre: []string{"0"}}
+	default:
+		return semver{major: v.major, minor: v.minor, patch: v.patch + 1, pre: []string{"0"}}
+	}
+}
+
+// comparator is a single version comparison, i.e. >=1.2.0.
+type comparator struct {
+	op string // One of =, <, <=, >, >=.
+	v  semver
+}
+
+func (c comparator) match(v semver) bool {
+	cmp := v.compare(c.v)
+	switch c.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	default:
+		return cmp == 0
+	}
+}
+
+// constraint is a parsed version constraint: alternatives of comparators which must all match.
+type constraint [][]comparator
+
+// parseConstraint parses the given version constraint, i.e. ^1.2, ~1.4 or >=2.0 <3.
+// The comparators of a set are separated by spaces or commas, the sets by ||.
+// Supported operators: =, <, <=, >, >=, ^ (compatible: same major, or same minor for 0.x),
+// ~ (same minor) and x/* wildcards. Partial versions match all the versions they prefix.
+func parseConstraint(s string) (constraint, error) {
+	var ret constraint
+	for _, alt := range strings.Split(s, "||") {
+		var tokens []string
+		for _, tok := range strings.Fields(strings.Replace(alt, ",", " ", -1)) {
+			// Allow spaces between the operator and the version, i.e. ">= 2.0".
+			if n := len(tokens); n > 0 && strings.Trim(tokens[n-1], "<>=^~") == "" {
+				tokens[n-1] += tok
+				continue
+			}
+			tokens = append(tokens, tok)
+		}
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("invalid version constraint: %q", s)
+		}
+		var set []comparator
+		for _, tok := range tokens {
+			comparators, err := parseComparator(tok)
+			if err != nil {
+				return nil, fmt.Errorf("invalid version constraint %q: %s", s, err)
+			}
+			set = append(set, comparators...)
+		}
+		ret = append(ret, set)
+	}
+	return ret, nil
+}
+
+// parseComparator expands the given constraint token into plain comparators.
+func parseComparator(tok string) ([]comparator, error) {
+	op := tok[:len(tok)-len(strings.TrimLeft(tok, "<>=^~"))]
+	v, n, err := parsePartial(tok[len(op):])
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		// Wildcard, anything goes.
+		switch op {
+		case "", "=", ">=", "<=", "^", "~":
+			return nil, nil
+		default:
+			return nil, fmt.Errorf("invalid comparator: %q", tok)
+		}
+	}
+
+	switch op {
+	case "", "=":
+		if n == 3 {
+			return []comparator{{"=", v}}, nil
+		}
+		return []comparator{{">=", v}, {"<", v.bump(n)}}, nil
+	case "<":
+		if n < 3 {
+			// Exclude the pre-releases of the bound, i.e. <2 excludes 2.0.0-beta.
+			v.pre = []string{"0"}
+		}
+		return []comparator{{op, v}}, nil
+	case ">=":
+		return []comparator{{op, v}}, nil
+	case "<=":
+		if n == 3 {
+			return []comparator{{op, v}}, nil
+		}
+		return []comparator{{"<", v.bump(n)}}, nil
+	case ">":
+		if n == 3 {
+			return []comparator{{op, v}}, nil
+		}
+		return []comparator{{">=", v.bump(n)}}, nil
+	case "~":
+		if n == 1 {
+			return []comparator{{">=", v}, {"<", v.bump(1)}}, nil
+		}
+		return []comparator{{">=", v}, {"<", v.bump(2)}}, nil
+	case "^":
+		// Bump the first non-zero number, or the last specified one.
+		switch {
+		case v.major != 0 || n == 1:
+			return []comparator{{">=", v}, {"<", v.bump(1)}}, nil
+		case v.minor != 0 || n == 2:
+			return []comparator{{">=", v}, {"<", v.bump(2)}}, nil
+		default:
+			return []comparator{{">=", v}, {"<", v.bump(3)}}, nil
+		}
+	default:
+		return nil, fmt.Errorf("invalid operator: %q", op)
+	}
+}
+
+// match checks if the given version satisfies the constraint.
+// Pre-release versions only match if allowed.
+func (c constraint) match(v semver, prerelease bool) bool {
+	if v.pre != nil && !prerelease {
+		return false
+	}
+	for _, set := range c {
+		ok := true
+		for _, comp := range set {
+			if !comp.match(v) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchedVersion is a version name matching a constraint.
+type matchedVersion struct {
+	name string
+	v    semver
+}
+
+// byVersion sorts the matching versions from the highest to the lowest, then by name.
+type byVersion []matchedVersion
+
+func (s byVersion) Len() int      { return len(s) }
+func (s byVersion) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byVersion) Less(i, j int) bool {
+	if c := s[i].v.compare(s[j].v); c != 0 {
+		return c > 0
+	}
+	return s[i].name < s[j].name
+}
+
+// matchVersions returns the versions of the given service matching the constraint, highest first.
+// Non-semver version names never match.
+func (c *catalog) matchVersions(name string, cons constraint, flags RangeFlag) []string {
+	var matched []matchedVersion
+	for version := range c.services[name] {
+		v, err := parseSemver(version)
+		if err != nil || !cons.match(v, flags&RangePrerelease != 0) {
+			continue
+		}
+		matched = append(matched, matchedVersion{name: version, v: v})
+	}
+	sort.Sort(byVersion(matched))
+	ret := make([]string, 0, len(matched))
+	for _, m := range matched {
+		ret = append(ret, m.name)
+	}
+	return ret
+}
+
+// resolveEndpoint returns the version the given endpoint of the service name/version got looked up from:
+// the version itself or the target of the alias, see resolve, or the highest version matching the
+// constraint and listing the endpoint, see LookupRange. Returns the version as is when nothing matches.
+func (c *catalog) resolveEndpoint(name, version, endpoint string) string {
+	target := c.resolve(name, version)
+	if _, ok := c.lookup(name, target); ok || target != version {
+		return target
+	}
+	cons, err := parseConstraint(version)
+	if err != nil {
+		return version
+	}
+	// The pre-release versions only matter when the endpoint is not listed by a release.
+	for _, flags := range []RangeFlag{0, RangePrerelease} {
+		for _, v := range c.matchVersions(name, cons, flags) {
+			if list, _ := c.lookup(name, v); list.contains(endpoint) {
+				return v
+			}
+		}
+	}
+	return version
+}
+
+// lookupRange returns the endpoint list for the versions of the given service matching the constraint.
+// A version or an alias named after the constraint matches exactly, as do invalid constraints.
+func (reg *ZKRegistry) lookupRange(name, constraint string, flags RangeFlag) (*endpointList, error) {
+	current := reg.catalog()
+	version := current.resolve(name, constraint)
+	if list, ok := current.lookup(name, version); ok {
+		return reg.filterEjected(name, version, list), nil
+	} else if version != constraint {
+		// Alias of a missing version.
+		return nil, ErrServiceNotFound
+	}
+	cons, err := parseConstraint(constraint)
+	if err != nil {
+		// Not a constraint, only exact matches.
+		return nil, ErrServiceNotFound
+	}
+	versions := current.matchVersions(name, cons, flags)
+	if len(versions) == 0 {
+		return nil, ErrServiceNotFound
+	}
+
+	if flags&RangeMerge == 0 {
+		// The highest version with endpoints.
+		for _, version := range versions {
+			list, _ := current.lookup(name, version)
+			if len(list.endpoints) > 0 {
+				return reg.filterEjected(name, version, list), nil
+			}
+		}
+		list, _ := current.lookup(name, versions[0])
+		return list, nil
+	}
+
+	// Merge, the highest version first. Endpoints present in several versions are listed once.
+	var instances []Instance
+	seen := map[string]bool{}
+	for _, version := range versions {
+		list, _ := current.lookup(name, version)
+		for _, instance := range reg.filterEjected(name, version, list).instances {
+			if !seen[instance.Address] {
+				seen[instance.Address] = true
+				instances = append(instances, instance)
+			}
+		}
+	}
+	return newEndpointList(instances), nil
+}
+
+// LookupRange returns the endpoint list for the versions of the given service matching the semver constraint,
+// i.e. ^1.2, ~1.4 or >=2.0 <3, see parseConstraint. By default, the endpoints of the highest matching version
+// having endpoints are returned and the pre-release versions are ignored, see RangeFlag.
+// The version names are parsed as semver with an optional "v" prefix, the others only match exactly:
+// a version or an alias named after the constraint is always used as is, see SetAliases.
+// As for Lookup, ejected endpoints are excluded and the returned slice must not be modified.
+// Failure and Success accept the constraint, the endpoints are reported for the version listing them.
+func (reg *ZKRegistry) LookupRange(name, constraint string, flags RangeFlag) ([]string, error) {
+	list, err := reg.lookupRange(name, constraint, flags)
+	if err != nil {
+		return nil, err
+	}
+	return list.endpoints, nil
+}
+
+// LookupInstancesRange returns the endpoint list along with their metadata for the versions
+// of the given service matching the semver constraint, see LookupRange.
+func (reg *ZKRegistry) LookupInstancesRange(name, constraint string, flags RangeFlag) ([]Instance, error) {
+	list, err := reg.lookupRange(name, constraint, flags)
+	if err != nil {
+		return nil, err
+	}
+	return list.instances, nil
+}
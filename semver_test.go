@@ -0,0 +1,177 @@
+package zkregistry
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSemverCompare(t *testing.T) {
+	// In ascending order.
+	versions := []string{"0.9.9", "1.0.0-0", "1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta.2", "1.0.0-beta.11", "1.0.0", "v1.0.1", "1.2", "1.10.0", "v2"}
+	for i := range versions {
+		for j := range versions {
+			a, err := parseSemver(versions[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := parseSemver(versions[j])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expect, got := sign(i-j), a.compare(b); expect != got {
+				t.Errorf("Unexpected comparison of %s and %s.\nExpect:\t%d\nGot:\t%d", versions[i], versions[j], expect, got)
+			}
+		}
+	}
+
+	for _, version := range []string{"", "v", "version", "1.2.3.4", "1.-2", "1..2", "1.x", "1.2-beta", "1.2.3-", "1.2.3-a..b"} {
+		if _, err := parseSemver(version); err == nil {
+			t.Errorf("%q should not parse", version)
+		}
+	}
+}
+
+func TestConstraint(t *testing.T) {
+	for _, tc := range []struct {
+		constraint string
+		match      []string
+		noMatch    []string
+	}{
+		{constraint: "^1.2", match: []string{"1.2.0", "1.9.3", "v1.2.5"}, noMatch: []string{"1.1.9", "2.0.0", "2.0.0-beta"}},
+		{constraint: "^0.2.3", match: []string{"0.2.3", "0.2.9"}, noMatch: []string{"0.3.0", "0.2.2"}},
+		{constraint: "^0.0.3", match: []string{"0.0.3"}, noMatch: []string{"0.0.4"}},
+		{constraint: "~1.4", match: []string{"1.4.0", "1.4.7"}, noMatch: []string{"1.5.0", "1.3.9"}},
+		{constraint: "~1", match: []string{"1.0.0", "1.9.0"}, noMatch: []string{"2.0.0"}},
+		{constraint: ">=2.0 <3", match: []string{"2.0.0", "2.9.9", "v2"}, noMatch: []string{"1.9.9", "3.0.0"}},
+		{constraint: ">= 2.0, < 3", match: []string{"2.1.0"}, noMatch: []string{"3.0.0"}},
+		{constraint: ">1.2 <=2", match: []string{"1.3.0", "2.0.9"}, noMatch: []string{"1.2.9", "3.0.0"}},
+		{constraint: "1.2.x", match: []string{"1.2.0", "1.2.9"}, noMatch: []string{"1.3.0"}},
+		{constraint: "1.2.3", match: []string{"1.2.3", "v1.2.3+build"}, noMatch: []string{"1.2.4"}},
+		{constraint: "*", match: []string{"0.0.1", "9.0.0"}},
+		{constraint: "^1 || ^3", match: []string{"1.0.0", "3.1.0"}, noMatch: []string{"2.0.0"}},
+		{constraint: "^1", noMatch: []string{"1.5.0-rc.1"}},
+	} {
+		cons, err := parseConstraint(tc.constraint)
+		if err != nil {
+			t.Fatalf("Error parsing %q: %s", tc.constraint, err)
+		}
+		for _, version := range tc.match {
+			if v, _ := parseSemver(version); !cons.match(v, false) {
+				t.Errorf("%q should match %q", tc.constraint, version)
+			}
+		}
+		for _, version := range tc.noMatch {
+			if v, _ := parseSemver(version); cons.match(v, false) {
+				t.Errorf("%q should not match %q", tc.constraint, version)
+			}
+		}
+	}
+
+	// Pre-releases, when requested.
+	cons, err := parseConstraint("^1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for version, expect := range map[string]bool{"1.5.0-rc.1": true, "1.0.0-rc.1": false, "2.0.0-rc.1": false} {
+		if v, _ := parseSemver(version); cons.match(v, true) != expect {
+			t.Errorf("Unexpected pre-release match of %q.\nExpect:\t%t\nGot:\t%t", version, expect, !expect)
+		}
+	}
+
+	for _, constraint := range []string{"", "canary", ">", "<x", "^1.2.3.4", "1.2 - 2.0", "^1 ||"} {
+		if _, err := parseConstraint(constraint); err == nil {
+			t.Errorf("%q should not parse", constraint)
+		}
+	}
+}
+
+func TestLookupRange(t *testing.T) {
+	reg := newTestRegistry()
+	reg.logger = discardLogger
+	reg.Add("name", "1.4.2", "addr1")
+	reg.Add("name", "1.5.0", "addr2")
+	reg.Add("name", "1.5.0", "addr3")
+	reg.Add("name", "1.6.0-beta.1", "addr4")
+	reg.Add("name", "v2.0.0", "addr5")
+	reg.Add("name", "canary", "addr6")
+	reg.Add("name", "1.7.0", "addr7")
+	reg.DeleteEndpoint("name", "1.7.0", "addr7") // Empty version.
+
+	for _, tc := range []struct {
+		constraint string
+		flags      RangeFlag
+		expect     []string
+		expectErr  error
+	}{
+		{constraint: "^1.4", expect: []string{"addr2", "addr3"}},
+		{constraint: "~1.4", expect: []string{"addr1"}},
+		{constraint: ">=2.0 <3", expect: []string{"addr5"}},
+		{constraint: "^1.4", flags: RangeMerge, expect: []string{"addr2", "addr3", "addr1"}},
+		{constraint: "^1.4", flags: RangeMerge | RangePrerelease, expect: []string{"addr4", "addr2", "addr3", "addr1"}},
+		{constraint: "^1.6", expect: []string{}},
+		{constraint: "^1.7", flags: RangeMerge, expect: []string{}},
+		{constraint: "^1.5", flags: RangePrerelease, expect: []string{"addr4"}},
+		{constraint: "1.4.2", expect: []string{"addr1"}},
+		{constraint: "canary", expect: []string{"addr6"}},
+		{constraint: "stable", expectErr: ErrServiceNotFound},
+		{constraint: "^3", expectErr: ErrServiceNotFound},
+	} {
+		got, err := reg.LookupRange("name", tc.constraint, tc.flags)
+		if err != tc.expectErr {
+			t.Errorf("[%s] Unexpected error.\nExpect:\t%v\nGot:\t%v", tc.constraint, tc.expectErr, err)
+		} else if !reflect.DeepEqual(tc.expect, got) {
+			t.Errorf("[%s] Unexpected endpoints.\nExpect:\t%v\nGot:\t%v", tc.constraint, tc.expect, got)
+		}
+	}
+
+	if _, err := reg.LookupRange("other", "^1", 0); err != ErrServiceNotFound {
+		t.Fatalf("Unexpected error.\nExpect:\t%v\nGot:\t%v", ErrServiceNotFound, err)
+	}
+
+	// Ejected endpoints are excluded, falling back to the other versions in merge mode.
+	reg.SetOutlierDetection(OutlierDetection{ConsecutiveFailures: 1, BaseEjectionTime: time.Minute, MaxEjectionPercent: 100})
+	reg.Failure("name", "1.5.0", "addr2", errors.New("failure"))
+	if instances, err := reg.LookupInstancesRange("name", "^1.4", RangeMerge); err != nil || len(instances) != 2 || instances[0].Address != "addr3" {
+		t.Fatalf("Unexpected instances: %v (%v)", instances, err)
+	}
+}
+
+// Make sure the endpoints returned by LookupRange can be reported with the constraint.
+func TestResolveEndpoint(t *testing.T) {
+	reg := newTestRegistry()
+	reg.logger = discardLogger
+	reg.Add("name", "1.4.2", "addr1")
+	reg.Add("name", "1.5.0", "addr2")
+	reg.Add("name", "1.4.2", "addr3")
+	reg.Add("name", "1.5.0", "addr3")
+	reg.Add("name", "1.6.0-beta.1", "addr4")
+	reg.Add("name", "canary", "addr5")
+	reg.setAliases("name", map[string]string{"stable": "1.4.2"})
+
+	current := reg.catalog()
+	for _, tc := range []struct {
+		version, endpoint, expect string
+	}{
+		{version: "^1.4", endpoint: "addr1", expect: "1.4.2"},
+		{version: "^1.4", endpoint: "addr2", expect: "1.5.0"},
+		{version: "^1.4", endpoint: "addr3", expect: "1.5.0"}, // The highest version, as in merge mode.
+		{version: "^1.4", endpoint: "addr4", expect: "1.6.0-beta.1"},
+		{version: "^1.4", endpoint: "unknown", expect: "^1.4"},
+		{version: "stable", endpoint: "addr1", expect: "1.4.2"},
+		{version: "canary", endpoint: "addr5", expect: "canary"},
+		{version: "1.4.2", endpoint: "addr2", expect: "1.4.2"},
+	} {
+		if got := current.resolveEndpoint("name", tc.version, tc.endpoint); tc.expect != got {
+			t.Errorf("[%s %s] Unexpected version.\nExpect:\t%s\nGot:\t%s", tc.version, tc.endpoint, tc.expect, got)
+		}
+	}
+
+	// The ejection applies to the version listing the endpoint.
+	reg.SetOutlierDetection(OutlierDetection{ConsecutiveFailures: 1, BaseEjectionTime: time.Minute, MaxEjectionPercent: 100})
+	reg.Failure("name", "^1.4", "addr2", errors.New("failure"))
+	if got, err := reg.Lookup("name", "1.5.0"); err != nil || !reflect.DeepEqual([]string{"addr3"}, got) {
+		t.Fatalf("Unexpected endpoints: %v (%v)", got, err)
+	}
+}
@@ -0,0 +1,110 @@
+package zkregistry
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// serversetLayout is the Finagle/Aurora serverset layout: /<name>/member_<sequence>
+// with a JSON ServiceInstance as node data.
+// Serversets have no versions: the primary endpoint (serviceEndpoint) is listed under the empty
+// version and each additional endpoint under its name, i.e. Lookup("job", "http").
+// Only the ALIVE members are listed.
+type serversetLayout struct{}
+
+// serversetMemberPrefix is the node name prefix of the serverset members.
+const serversetMemberPrefix = "member_"
+
+// serversetAlive is the status of the members ready to serve.
+const serversetAlive = "ALIVE"
+
+// serversetEndpoint is the JSON form of the serverset Endpoint.
+type serversetEndpoint struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
+
+// serversetMember is the JSON form of the serverset ServiceInstance.
+type serversetMember struct {
+	ServiceEndpoint     *serversetEndpoint           `json:"serviceEndpoint"`
+	AdditionalEndpoints map[string]serversetEndpoint `json:"additionalEndpoints"`
+	Status              string                       `json:"status"`
+	Shard               *int                         `json:"shard,omitempty"`
+}
+
+func (serversetLayout) Depth() int { return 2 }
+
+func (serversetLayout) Parse(elems []string) (Key, error) {
+	switch len(elems) {
+	case 0:
+		return Key{}, nil
+	case 1:
+		return Key{Name: elems[0]}, nil
+	case 2:
+		if !strings.HasPrefix(elems[1], serversetMemberPrefix) {
+			return Key{}, fmt.Errorf("invalid serverset member: %q", elems[1])
+		}
+		return Key{Name: elems[0], Endpoint: elems[1]}, nil
+	default:
+		return Key{}, fmt.Errorf("invalid serverset path: %q", elems)
+	}
+}
+
+func (serversetLayout) Decode(key Key, data []byte) ([]Entry, error) {
+	var member serversetMember
+	if err := json.Unmarshal(data, &member); err != nil {
+		return nil, fmt.Errorf("invalid serverset member: %s", err)
+	}
+	if member.Status != serversetAlive {
+		return nil, nil
+	}
+	var meta Metadata
+	if member.Shard != nil {
+		meta.Tags = []string{"shard:" + strconv.Itoa(*member.Shard)}
+	}
+
+	var entries []Entry
+	if e := member.ServiceEndpoint; e != nil && e.Host != "" {
+		entries = append(entries, Entry{
+			Key:      Key{Name: key.Name, Endpoint: net.JoinHostPort(e.Host, strconv.Itoa(e.Port))},
+			Metadata: meta,
+		})
+	}
+	for name, e := range member.AdditionalEndpoints {
+		entries = append(entries, Entry{
+			Key:      Key{Name: key.Name, Version: name, Endpoint: net.JoinHostPort(e.Host, strconv.Itoa(e.Port))},
+			Metadata: meta,
+		})
+	}
+	return entries, nil
+}
+
+func (serversetLayout) Node(key Key) ([]string, error) {
+	return []string{key.Name, serversetMemberPrefix}, nil
+}
+
+// Encode publishes the endpoint both as primary and as the additional endpoint named after the version.
+// The metadata is not stored.
+func (serversetLayout) Encode(key Key, node string, meta Metadata) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(key.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid serverset endpoint %q: %s", key.Endpoint, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid serverset endpoint %q: %s", key.Endpoint, err)
+	}
+	endpoint := serversetEndpoint{Host: host, Port: port}
+	return json.Marshal(serversetMember{
+		ServiceEndpoint:     &endpoint,
+		AdditionalEndpoints: map[string]serversetEndpoint{key.Version: endpoint},
+		Status:              serversetAlive,
+	})
+}
+
+func (serversetLayout) Flags() int32 { return zk.FlagSequence }
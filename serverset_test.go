@@ -0,0 +1,148 @@
+package zkregistry
+
+import (
+	"encoding/json"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// aliveMember is a serverset member as published by Aurora.
+const aliveMember = `{
+	"serviceEndpoint": {"host": "10.0.0.1", "port": 31000},
+	"additionalEndpoints": {
+		"http": {"host": "10.0.0.1", "port": 31000},
+		"admin": {"host": "10.0.0.1", "port": 31001}
+	},
+	"status": "ALIVE",
+	"shard": 3
+}`
+
+func TestServersetDecode(t *testing.T) {
+	key := Key{Name: "job", Endpoint: "member_0000000001"}
+	shard := Metadata{Tags: []string{"shard:3"}}
+	for _, elem := range []struct {
+		data    string
+		expect  []Entry
+		invalid bool
+	}{
+		{data: aliveMember, expect: []Entry{
+			{Key: Key{Name: "job", Endpoint: "10.0.0.1:31000"}, Metadata: shard},
+			{Key: Key{Name: "job", Version: "admin", Endpoint: "10.0.0.1:31001"}, Metadata: shard},
+			{Key: Key{Name: "job", Version: "http", Endpoint: "10.0.0.1:31000"}, Metadata: shard},
+		}},
+		{data: `{"serviceEndpoint": {"host": "10.0.0.1", "port": 31000}, "status": "ALIVE"}`, expect: []Entry{{Key: Key{Name: "job", Endpoint: "10.0.0.1:31000"}}}},
+		{data: strings.Replace(aliveMember, "ALIVE", "STARTING", 1)},
+		{data: strings.Replace(aliveMember, "ALIVE", "DEAD", 1)},
+		{data: `{"serviceEndpoint": {"host": "10.0.0.1", "port": 31000}}`},
+		{data: `invalid`, invalid: true},
+	} {
+		got, err := serversetLayout{}.Decode(key, []byte(elem.data))
+		if elem.invalid != (err != nil) {
+			t.Errorf("[%s] Unexpected error: %v", elem.data, err)
+			continue
+		}
+		sort.Sort(byKey(got))
+		if !reflect.DeepEqual(elem.expect, got) {
+			t.Errorf("[%s] Unexpected entries.\nExpect:\t%v\nGot:\t%v", elem.data, elem.expect, got)
+		}
+	}
+
+	if _, err := (serversetLayout{}).Parse([]string{"job", "other"}); err == nil {
+		t.Fatal("Nodes other than the members should be rejected")
+	}
+}
+
+// byKey sorts the entries by version.
+type byKey []Entry
+
+func (s byKey) Len() int           { return len(s) }
+func (s byKey) Less(i, j int) bool { return s[i].Key.Version < s[j].Key.Version }
+func (s byKey) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func TestServersetEncode(t *testing.T) {
+	data, err := serversetLayout{}.Encode(Key{Name: "job", Version: "http", Endpoint: "127.0.0.1:9000"}, serversetMemberPrefix, Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var member map[string]interface{}
+	if err := json.Unmarshal(data, &member); err != nil {
+		t.Fatal(err)
+	}
+	endpoint := map[string]interface{}{"host": "127.0.0.1", "port": 9000.}
+	expect := map[string]interface{}{
+		"serviceEndpoint":     endpoint,
+		"additionalEndpoints": map[string]interface{}{"http": endpoint},
+		"status":              "ALIVE",
+	}
+	if !reflect.DeepEqual(expect, member) {
+		t.Fatalf("Unexpected member.\nExpect:\t%v\nGot:\t%v", expect, member)
+	}
+
+	if _, err := (serversetLayout{}).Encode(Key{Name: "job", Version: "http", Endpoint: "addr"}, serversetMemberPrefix, Metadata{}); err == nil {
+		t.Fatal("Endpoints without port should fail")
+	}
+}
+
+func TestServersetRegistry(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	assertCreateTree(t, conn, "/aurora/role/prod/job")
+	member, err := conn.conn.Create(path.Join(conn.prefix, "/aurora/role/prod/job/member_"), []byte(aliveMember), zk.FlagSequence, zk.WorldACL(zk.PermAll))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := New(conn.conn, path.Join(conn.prefix, "/aurora/role/prod"), discardLogger, WithServersetLayout())
+	if err != nil {
+		t.Fatalf("Error creating the registry: %s", err)
+	}
+	defer func() { _ = reg.Close() }() // Best effort.
+
+	assertEventualLookup(t, reg, "job", "", []string{"10.0.0.1:31000"}, nil)
+	assertEventualLookup(t, reg, "job", "admin", []string{"10.0.0.1:31001"}, nil)
+
+	r, err := reg.Register("job", "http", "127.0.0.1:9000")
+	if err != nil {
+		t.Fatalf("Error registering Endpoint: %s", err)
+	}
+	if dir, node := path.Split(r.Path()); dir != path.Join(conn.prefix, "/aurora/role/prod/job")+"/" || len(node) != len("member_0000000001") || !strings.HasPrefix(node, "member_") {
+		t.Fatalf("Unexpected registration path: %s", r.Path())
+	}
+	assertEventualLookup(t, reg, "job", "", []string{"10.0.0.1:31000", "127.0.0.1:9000"}, nil)
+	assertEventualLookup(t, reg, "job", "http", []string{"10.0.0.1:31000", "127.0.0.1:9000"}, nil)
+
+	// Members going out of service are removed.
+	if _, err := conn.conn.Set(member, []byte(strings.Replace(aliveMember, "ALIVE", "STOPPING", 1)), -1); err != nil {
+		t.Fatal(err)
+	}
+	assertEventualLookup(t, reg, "job", "", []string{"127.0.0.1:9000"}, nil)
+	assertEventualLookup(t, reg, "job", "admin", nil, ErrServiceNotFound)
+
+	// Lost members are re-created with a new sequence.
+	previous := r.Path()
+	if err := conn.conn.Delete(previous, -1); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for r.Path() == previous {
+		if time.Now().After(deadline) {
+			t.Fatalf("The member should have been re-created with a new sequence: %s", previous)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertZKPathExist(t, conn, r.Path())
+	assertEventualLookup(t, reg, "job", "http", []string{"127.0.0.1:9000"}, nil)
+
+	if err := r.Deregister(); err != nil {
+		t.Fatal(err)
+	}
+	assertZKPathNotExist(t, conn, r.Path())
+	assertEventualLookup(t, reg, "job", "http", nil, ErrServiceNotFound)
+}
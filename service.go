@@ -0,0 +1,187 @@
+package zkregistry
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// serviceRetries is the number of attempts of the service node updates when modified concurrently.
+const serviceRetries = 5
+
+// Fields of the service node data, i.e. {"aliases": {"stable": "1.4.2"}, "split": {"1.4.2": 95, "1.5.0": 5}}.
+const (
+	aliasesField = "aliases"
+	splitField   = "split"
+)
+
+// serviceData is the JSON data of a service node, see SetAliases and SetSplit.
+// The unknown fields are preserved.
+type serviceData struct {
+	fields  map[string]*json.RawMessage // NOTE: pointers for the values to be marshaled as is.
+	aliases map[string]string
+	split   map[string]int
+}
+
+// parseServiceData decodes the given service node data, empty data being an empty object.
+func parseServiceData(data []byte) (*serviceData, error) {
+	ret := &serviceData{fields: map[string]*json.RawMessage{}}
+	if len(data) == 0 {
+		return ret, nil
+	}
+	if err := json.Unmarshal(data, &ret.fields); err != nil {
+		return nil, fmt.Errorf("invalid service node data: %s", err)
+	}
+	if raw := ret.fields[aliasesField]; raw != nil {
+		if err := json.Unmarshal(*raw, &ret.aliases); err != nil {
+			return nil, fmt.Errorf("invalid service aliases: %s", err)
+		}
+	}
+	if raw := ret.fields[splitField]; raw != nil {
+		if err := json.Unmarshal(*raw, &ret.split); err != nil {
+			return nil, fmt.Errorf("invalid service split: %s", err)
+		}
+	}
+	return ret, nil
+}
+
+// encode returns the service node data, empty aliases or split being removed.
+func (s *serviceData) encode() ([]byte, error) {
+	if err := s.setField(aliasesField, s.aliases, len(s.aliases) == 0); err != nil {
+		return nil, err
+	}
+	if err := s.setField(splitField, s.split, len(s.split) == 0); err != nil {
+		return nil, err
+	}
+	return json.Marshal(s.fields)
+}
+
+// setField sets the given field of the service node data, or removes it if empty.
+func (s *serviceData) setField(field string, value interface{}, empty bool) error {
+	if empty {
+		delete(s.fields, field)
+		return nil
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	s.fields[field] = (*json.RawMessage)(&raw)
+	return nil
+}
+
+// isServiceNode checks if the given parent node is the node of its service,
+// the first level of the tree carrying the service name.
+func (reg *ZKRegistry) isServiceNode(elems []string, key Key) bool {
+	if len(elems) == 0 || len(elems) >= reg.layout.Depth() || key.Name == "" || key.Version != "" {
+		return false
+	}
+	parent, err := reg.parse(elems[:len(elems)-1])
+	return err == nil && parent.Name == ""
+}
+
+// readServiceNode fetches and applies the aliases and the split of the given service node.
+// Invalid data is logged, the last known state is kept.
+// NOTE: expected to be called from the watcher goroutine.
+func (reg *ZKRegistry) readServiceNode(zkPath, name string) {
+	data, _, err := reg.conn.Get(zkPath)
+	if err == zk.ErrNoNode {
+		return
+	} else if err != nil {
+		reg.logger.Printf("error reading service data %q: %s", zkPath, err)
+		return
+	}
+	service, err := parseServiceData(data)
+	if err != nil {
+		reg.logger.Printf("error parsing service data %q: %s", zkPath, err)
+		return
+	}
+	reg.setAliases(name, service.aliases)
+	reg.setSplit(name, service.split)
+}
+
+// servicePaths returns the path elements of the service node and of the version node of the given service name/version.
+// The version node is nil for the layouts without version level, i.e. Curator.
+func (reg *ZKRegistry) servicePaths(name, version string) ([]string, []string, error) {
+	elems, err := reg.layout.Node(Key{Name: name, Version: version, Endpoint: "service"})
+	if err != nil {
+		return nil, nil, err
+	}
+	var service, versionNode []string
+	for i := 1; i < len(elems); i++ {
+		key, err := reg.parse(elems[:i])
+		if err != nil {
+			return nil, nil, err
+		}
+		if key.Name == name && service == nil {
+			service = elems[:i]
+			if version == "" {
+				break
+			}
+		}
+		if version != "" && key.Version == version {
+			versionNode = elems[:i]
+			break
+		}
+	}
+	if service == nil {
+		return nil, nil, fmt.Errorf("layout without service node for %q", name)
+	}
+	return service, versionNode, nil
+}
+
+// versionCheck returns the operation checking the existence of the given version along with a service node update.
+// Returns nil for the layouts without version nodes, after checking the known versions.
+func (reg *ZKRegistry) versionCheck(name, version string) (interface{}, error) {
+	_, versionNode, err := reg.servicePaths(name, version)
+	if err != nil {
+		return nil, err
+	}
+	if versionNode == nil {
+		// No version node to check, rely on the known versions.
+		if _, ok := reg.catalog().lookup(name, version); !ok {
+			return nil, fmt.Errorf("unknown version %s/%s: %s", name, version, ErrServiceNotFound)
+		}
+		return nil, nil
+	}
+	return &zk.CheckVersionRequest{Path: reg.nodePath(versionNode), Version: -1}, nil
+}
+
+// updateServiceNode applies the given change to the service node data along with the given checks,
+// in a single check-and-set transaction retried when the node gets modified concurrently.
+func (reg *ZKRegistry) updateServiceNode(name string, checks []interface{}, update func(*serviceData)) error {
+	elems, _, err := reg.servicePaths(name, "")
+	if err != nil {
+		return err
+	}
+	zkPath := reg.nodePath(elems)
+
+	for i := 0; ; i++ {
+		data, stat, err := reg.conn.Get(zkPath)
+		if err == zk.ErrNoNode {
+			return ErrServiceNotFound
+		} else if err != nil {
+			return fmt.Errorf("error reading %q: %s", zkPath, err)
+		}
+		service, err := parseServiceData(data)
+		if err != nil {
+			return err
+		}
+		update(service)
+		if data, err = service.encode(); err != nil {
+			return err
+		}
+
+		ops := append(append([]interface{}{}, checks...), &zk.SetDataRequest{Path: zkPath, Data: data, Version: stat.Version})
+		_, err = reg.conn.Multi(ops...)
+		if err == zk.ErrBadVersion && i+1 < serviceRetries {
+			continue
+		} else if err == zk.ErrNoNode {
+			return fmt.Errorf("error updating %s, unknown version or service: %s", name, ErrServiceNotFound)
+		} else if err != nil {
+			return fmt.Errorf("error updating %s: %s", name, err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,37 @@
+package zkregistry
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseServiceData(t *testing.T) {
+	for data, expect := range map[string]serviceData{
+		``:                                   {},
+		`{}`:                                 {},
+		`{"owner": "team"}`:                  {},
+		`{"aliases": {"stable": "1.4.2"}}`:   {aliases: map[string]string{"stable": "1.4.2"}},
+		`{"aliases": null, "owner": "team"}`: {},
+		`{"split": {"3.1": 95, "3.2": 5}}`:   {split: map[string]int{"3.1": 95, "3.2": 5}},
+	} {
+		if got, err := parseServiceData([]byte(data)); err != nil || !reflect.DeepEqual(expect.aliases, got.aliases) || !reflect.DeepEqual(expect.split, got.split) {
+			t.Errorf("[%s] Unexpected service data.\nExpect:\t%+v\nGot:\t%+v (%v)", data, expect, got, err)
+		}
+	}
+	for _, data := range []string{`invalid`, `{"aliases": ["stable"]}`, `{"split": {"3.1": "95"}}`} {
+		if _, err := parseServiceData([]byte(data)); err == nil {
+			t.Errorf("%q should not parse", data)
+		}
+	}
+
+	// Round trip, the unknown fields are preserved and the empty ones removed.
+	service, err := parseServiceData([]byte(`{"owner": "team", "aliases": {"stable": "1.4.2"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.aliases = nil
+	service.split = map[string]int{"1.4.2": 1}
+	if data, err := service.encode(); err != nil || string(data) != `{"owner":"team","split":{"1.4.2":1}}` {
+		t.Fatalf("Unexpected service data: %s (%v)", data, err)
+	}
+}
@@ -0,0 +1,113 @@
+package zkregistry
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// Snapshot is an immutable view of the registry catalog.
+type Snapshot struct {
+	catalog *catalog
+}
+
+// copyInstance deep copies the given instance.
+func copyInstance(instance Instance) Instance {
+	if instance.Metadata.Tags != nil {
+		instance.Metadata.Tags = append([]string(nil), instance.Metadata.Tags...)
+	}
+	return instance
+}
+
+// sortedKeys returns the sorted keys of the given map.
+func sortedKeys(m map[string]map[string]*endpointList) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Snapshot returns a view of the current registry catalog.
+// Taking a snapshot is free: the catalog is never modified once published.
+// NOTE: the endpoint lists reflect the zookeeper state, ejection is not applied.
+func (reg *ZKRegistry) Snapshot() *Snapshot {
+	return &Snapshot{catalog: reg.catalog()}
+}
+
+// Services returns the sorted list of the known service names.
+func (reg *ZKRegistry) Services() []string {
+	return reg.Snapshot().Services()
+}
+
+// Versions returns the sorted list of the known versions for the given service name.
+func (reg *ZKRegistry) Versions(name string) ([]string, error) {
+	return reg.Snapshot().Versions(name)
+}
+
+// Revision returns the registry revision the snapshot has been taken at.
+// The revision is incremented on each change of the registry.
+func (snap *Snapshot) Revision() uint64 {
+	return snap.catalog.revision
+}
+
+// Services returns the sorted list of the service names.
+func (snap *Snapshot) Services() []string {
+	return sortedKeys(snap.catalog.services)
+}
+
+// Versions returns the sorted list of versions for the given service name.
+func (snap *Snapshot) Versions(name string) ([]string, error) {
+	versions, ok := snap.catalog.services[name]
+	if !ok {
+		return nil, ErrServiceNotFound
+	}
+	ret := make([]string, 0, len(versions))
+	for version := range versions {
+		ret = append(ret, version)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// Instances returns the endpoints along with their metadata for the given service name/version.
+func (snap *Snapshot) Instances(name, version string) ([]Instance, error) {
+	list, ok := snap.catalog.lookup(name, version)
+	if !ok {
+		return nil, ErrServiceNotFound
+	}
+	ret := make([]Instance, 0, len(list.instances))
+	for _, instance := range list.instances {
+		ret = append(ret, copyInstance(instance))
+	}
+	return ret, nil
+}
+
+// Endpoints returns the endpoint list for the given service name/version.
+func (snap *Snapshot) Endpoints(name, version string) ([]string, error) {
+	list, ok := snap.catalog.lookup(name, version)
+	if !ok {
+		return nil, ErrServiceNotFound
+	}
+	ret := make([]string, len(list.endpoints))
+	copy(ret, list.endpoints)
+	return ret, nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (snap *Snapshot) MarshalJSON() ([]byte, error) {
+	services := make(map[string]map[string][]Instance, len(snap.catalog.services))
+	for name, versions := range snap.catalog.services {
+		services[name] = make(map[string][]Instance, len(versions))
+		for version, list := range versions {
+			services[name][version] = list.instances
+		}
+	}
+	return json.Marshal(struct {
+		Revision uint64                           `json:"revision"`
+		Services map[string]map[string][]Instance `json:"services"`
+	}{
+		Revision: snap.catalog.revision,
+		Services: services,
+	})
+}
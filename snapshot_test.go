@@ -0,0 +1,108 @@
+package zkregistry
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestServicesVersions(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	if got := conn.Services(); len(got) != 0 {
+		t.Fatalf("Unexpected services: %v", got)
+	}
+
+	conn.Add("name2", "version", "addr")
+	conn.Add("name1", "version2", "addr")
+	conn.Add("name1", "version1", "addr")
+
+	if expect, got := []string{"name1", "name2"}, conn.Services(); !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected services.\nExpect:\t%v\nGot:\t%v", expect, got)
+	}
+	if got, err := conn.Versions("name1"); err != nil {
+		t.Fatal(err)
+	} else if expect := []string{"version1", "version2"}; !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected versions.\nExpect:\t%v\nGot:\t%v", expect, got)
+	}
+	if _, err := conn.Versions("unknown"); err != ErrServiceNotFound {
+		t.Fatalf("Unexpected error.\nExpect:\t%v\nGot:\t%v", ErrServiceNotFound, err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	conn.add("name", "version", "addr1", Metadata{Weight: 2, Tags: []string{"a"}})
+	conn.Add("name", "version", "addr2")
+
+	snap := conn.Snapshot()
+
+	// Change the registry, the snapshot should not be affected.
+	conn.Add("name", "version", "addr3")
+	conn.Add("other", "version", "addr")
+	if next := conn.Snapshot(); next.Revision() <= snap.Revision() {
+		t.Fatalf("Revision should increase on change: %d <= %d", next.Revision(), snap.Revision())
+	}
+
+	if expect, got := []string{"name"}, snap.Services(); !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected services.\nExpect:\t%v\nGot:\t%v", expect, got)
+	}
+	if got, err := snap.Versions("name"); err != nil {
+		t.Fatal(err)
+	} else if expect := []string{"version"}; !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected versions.\nExpect:\t%v\nGot:\t%v", expect, got)
+	}
+	if got, err := snap.Endpoints("name", "version"); err != nil {
+		t.Fatal(err)
+	} else if expect := []string{"addr1", "addr2"}; !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected endpoints.\nExpect:\t%v\nGot:\t%v", expect, got)
+	}
+
+	// Mutating the result should not affect the snapshot.
+	instances, err := snap.Instances("name", "version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	instances[0].Metadata.Tags[0] = "mutated"
+	instances[0].Address = "mutated"
+	expect := []Instance{
+		{Address: "addr1", Metadata: Metadata{Weight: 2, Tags: []string{"a"}}},
+		{Address: "addr2"},
+	}
+	if got, err := snap.Instances("name", "version"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected instances.\nExpect:\t%+v\nGot:\t%+v", expect, got)
+	}
+
+	if _, err := snap.Instances("name", "unknown"); err != ErrServiceNotFound {
+		t.Fatalf("Unexpected error.\nExpect:\t%v\nGot:\t%v", ErrServiceNotFound, err)
+	}
+	if _, err := snap.Endpoints("unknown", "version"); err != ErrServiceNotFound {
+		t.Fatalf("Unexpected error.\nExpect:\t%v\nGot:\t%v", ErrServiceNotFound, err)
+	}
+	if _, err := snap.Versions("unknown"); err != ErrServiceNotFound {
+		t.Fatalf("Unexpected error.\nExpect:\t%v\nGot:\t%v", ErrServiceNotFound, err)
+	}
+}
+
+func TestSnapshotJSON(t *testing.T) {
+	snap := &Snapshot{
+		catalog: &catalog{
+			revision: 42,
+			services: map[string]map[string]*endpointList{
+				"name": {"version": newEndpointList([]Instance{{Address: "addr"}})},
+			},
+		},
+	}
+	buf, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect, got := `{"revision":42,"services":{"name":{"version":[{"address":"addr","metadata":{}}]}}}`, string(buf); expect != got {
+		t.Fatalf("Unexpected data.\nExpect:\t%s\nGot:\t%s", expect, got)
+	}
+}
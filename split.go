@@ -0,0 +1,219 @@
+package zkregistry
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+)
+
+// PickOption tunes PickVersion and NextAcrossVersions.
+type PickOption func(*pickConfig)
+
+// pickConfig is the configuration of a pick, see PickOption.
+type pickConfig struct {
+	callerKey string
+}
+
+// WithCallerKey makes the pick deterministic for the given caller, i.e. a user or a session id:
+// the caller gets the same version, and endpoint, as long as the split and the endpoints do not change.
+// The version is picked with weighted rendezvous hashing: raising the weight of a version only moves callers to it,
+// and removing a version only moves its own callers.
+func WithCallerKey(key string) PickOption {
+	return func(cfg *pickConfig) {
+		cfg.callerKey = key
+	}
+}
+
+// hashKey hashes the given strings, used for the deterministic picks.
+func hashKey(parts ...string) uint64 {
+	h := fnv.New64a()
+	for _, part := range parts {
+		_, _ = h.Write([]byte(part)) // Never fails.
+		_, _ = h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
+
+// mix64 spreads the bits of the given hash, FNV alone being poorly distributed for the similar short keys.
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// setSplit sets the traffic split of the given service. A nil split removes it.
+func (reg *ZKRegistry) setSplit(name string, split map[string]int) {
+	if len(split) == 0 {
+		split = nil
+	}
+
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	current := reg.catalog()
+	if reflect.DeepEqual(current.splits[name], split) {
+		return
+	}
+	reg.commitLocked(current.withSplit(name, split))
+}
+
+// Split returns the traffic split of the given service name, i.e. {"3.1": 95, "3.2": 5}.
+func (reg *ZKRegistry) Split(name string) map[string]int {
+	split := reg.catalog().splits[name]
+	ret := make(map[string]int, len(split))
+	for version, weight := range split {
+		ret[version] = weight
+	}
+	return ret
+}
+
+// SetSplit replaces the traffic split of the given service, see PickVersion.
+// The weights are relative, i.e. {"3.1": 95, "3.2": 5} sends 5% of the calls to 3.2.
+// An empty split removes it.
+// The split is stored in the service node, the versions must exist and are checked along with the update.
+func (reg *ZKRegistry) SetSplit(name string, split map[string]int) error {
+	if err := validatePathElem("service name", name); err != nil {
+		return err
+	}
+	var checks []interface{}
+	total := 0
+	for version, weight := range split {
+		if err := validatePathElem("service version", version); err != nil {
+			return err
+		}
+		if weight < 0 {
+			return fmt.Errorf("invalid weight for %s/%s: %d", name, version, weight)
+		}
+		total += weight
+		check, err := reg.versionCheck(name, version)
+		if err != nil {
+			return err
+		}
+		if check != nil {
+			checks = append(checks, check)
+		}
+	}
+	if len(split) > 0 && total == 0 {
+		return fmt.Errorf("invalid split for %s: no weight", name)
+	}
+
+	return reg.updateServiceNode(name, checks, func(service *serviceData) {
+		service.split = split
+	})
+}
+
+// splitCandidate is a version of a split with available endpoints.
+type splitCandidate struct {
+	version   string
+	weight    int
+	instances []Instance
+}
+
+// pickVersion returns the version picked from the traffic split of the given service, along with its available instances.
+func (reg *ZKRegistry) pickVersion(name string, cfg pickConfig) (splitCandidate, error) {
+	current := reg.catalog()
+	split := current.splits[name]
+	if len(split) == 0 {
+		if _, ok := current.services[name]; !ok {
+			return splitCandidate{}, ErrServiceNotFound
+		}
+		return splitCandidate{}, ErrNoSplit
+	}
+
+	// Sorted for the deterministic picks.
+	versions := make([]string, 0, len(split))
+	for version := range split {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+
+	// Only the versions with available endpoints.
+	var candidates []splitCandidate
+	total := 0
+	for _, version := range versions {
+		list, ok := current.lookup(name, version)
+		if !ok || len(list.instances) == 0 || split[version] <= 0 {
+			continue
+		}
+		candidates = append(candidates, splitCandidate{
+			version:   version,
+			weight:    split[version],
+			instances: reg.filterEjected(name, version, list).instances,
+		})
+		total += split[version]
+	}
+	if len(candidates) == 0 {
+		return splitCandidate{}, ErrNoEndpoints
+	}
+
+	if cfg.callerKey != "" {
+		return rendezvous(name, cfg.callerKey, candidates), nil
+	}
+
+	// Point in [0, total), the candidates own consecutive ranges proportional to their weight.
+	n := rand.Float64() * float64(total)
+	for _, c := range candidates {
+		if n -= float64(c.weight); n < 0 {
+			return c, nil
+		}
+	}
+	return candidates[len(candidates)-1], nil
+}
+
+// rendezvous returns the candidate with the highest weighted score for the given caller.
+// Each score only depends on its own version and weight, so a change of the split
+// only moves the callers to, or away from, the versions it changes.
+func rendezvous(name, callerKey string, candidates []splitCandidate) splitCandidate {
+	best, bestScore := 0, math.Inf(-1)
+	for i, c := range candidates {
+		// Uniform in (0, 1), the score -weight/ln(u) makes the wins proportional to the weights.
+		// NOTE: not the same hash as the endpoint pick, see NextAcrossVersions.
+		u := (float64(mix64(hashKey(name, callerKey, c.version))>>11) + 0.5) / (1 << 53)
+		if score := -float64(c.weight) / math.Log(u); score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return candidates[best]
+}
+
+// PickVersion returns a version of the given service according to its traffic split, see SetSplit.
+// Only the versions with endpoints are picked, the others' share goes to the rest of the split.
+// Returns ErrNoSplit if the service has no split.
+func (reg *ZKRegistry) PickVersion(name string, opts ...PickOption) (string, error) {
+	var cfg pickConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	c, err := reg.pickVersion(name, cfg)
+	if err != nil {
+		return "", err
+	}
+	return c.version, nil
+}
+
+// NextAcrossVersions returns an endpoint of the given service, from the version picked by PickVersion.
+// The endpoint is picked with the WeightedRandom strategy, or hashed from the caller key, see WithCallerKey.
+// Returns the endpoint along with its version, i.e. for Failure.
+// As for Lookup, ejected endpoints are excluded.
+func (reg *ZKRegistry) NextAcrossVersions(name string, opts ...PickOption) (string, string, error) {
+	var cfg pickConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	c, err := reg.pickVersion(name, cfg)
+	if err != nil {
+		return "", "", err
+	}
+	intn := rand.Intn
+	if cfg.callerKey != "" {
+		h := hashKey(name, c.version, cfg.callerKey)
+		intn = func(n int) int { return int(h % uint64(n)) }
+	}
+	return pickWeighted(c.instances, intn), c.version, nil
+}
@@ -0,0 +1,246 @@
+package zkregistry
+
+import (
+	"path"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPickVersion(t *testing.T) {
+	reg := newTestRegistry()
+	reg.Add("payments", "3.1", "addr1")
+	reg.Add("payments", "3.1", "addr2")
+	reg.Add("payments", "3.2", "addr3")
+	reg.Add("payments", "3.3", "addr4")
+
+	if _, err := reg.PickVersion("payments"); err != ErrNoSplit {
+		t.Fatalf("Unexpected error.\nExpect:\t%v\nGot:\t%v", ErrNoSplit, err)
+	}
+	if _, err := reg.PickVersion("unknown"); err != ErrServiceNotFound {
+		t.Fatalf("Unexpected error.\nExpect:\t%v\nGot:\t%v", ErrServiceNotFound, err)
+	}
+
+	reg.setSplit("payments", map[string]int{"3.1": 95, "3.2": 5, "3.3": 0})
+	counts := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		version, err := reg.PickVersion("payments")
+		if err != nil {
+			t.Fatalf("Error picking version: %s", err)
+		}
+		counts[version]++
+	}
+	if counts["3.2"] < 300 || counts["3.2"] > 700 || counts["3.3"] != 0 || counts["3.1"]+counts["3.2"] != 10000 {
+		t.Fatalf("Unexpected distribution: %v", counts)
+	}
+
+	// The callers keep their version, raising the weight of 3.2 only moves callers to it.
+	picked := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		caller := strconv.Itoa(i)
+		version, err := reg.PickVersion("payments", WithCallerKey(caller))
+		if err != nil {
+			t.Fatalf("Error picking version: %s", err)
+		}
+		if again, _ := reg.PickVersion("payments", WithCallerKey(caller)); again != version {
+			t.Fatalf("Unstable pick for %s: %s then %s", caller, version, again)
+		}
+		picked[caller] = version
+	}
+	reg.setSplit("payments", map[string]int{"3.1": 50, "3.2": 50})
+	moved := 0
+	for caller, previous := range picked {
+		version, _ := reg.PickVersion("payments", WithCallerKey(caller))
+		if previous == "3.2" && version != "3.2" {
+			t.Fatalf("Caller %s moved away from 3.2", caller)
+		}
+		if version != previous {
+			moved++
+		}
+	}
+	if moved < 350 || moved > 550 {
+		t.Fatalf("Unexpected number of moved callers: %d", moved)
+	}
+
+	// The versions without endpoints are skipped.
+	reg.DeleteEndpoint("payments", "3.2", "addr3")
+	for i := 0; i < 100; i++ {
+		endpoint, version, err := reg.NextAcrossVersions("payments")
+		if err != nil {
+			t.Fatalf("Error picking endpoint: %s", err)
+		}
+		if version != "3.1" || (endpoint != "addr1" && endpoint != "addr2") {
+			t.Fatalf("Unexpected pick: %s (%s)", endpoint, version)
+		}
+	}
+	first, _, _ := reg.NextAcrossVersions("payments", WithCallerKey("caller"))
+	for i := 0; i < 10; i++ {
+		if endpoint, _, _ := reg.NextAcrossVersions("payments", WithCallerKey("caller")); endpoint != first {
+			t.Fatalf("Unstable endpoint: %s then %s", first, endpoint)
+		}
+	}
+
+	reg.DeleteVersion("payments", "3.1")
+	if _, _, err := reg.NextAcrossVersions("payments"); err != ErrNoEndpoints {
+		t.Fatalf("Unexpected error.\nExpect:\t%v\nGot:\t%v", ErrNoEndpoints, err)
+	}
+}
+
+// Make sure the split changes only move the callers to, or away from, the changed versions.
+func TestPickVersionCallerKey(t *testing.T) {
+	reg := newTestRegistry()
+	reg.Add("payments", "3.1", "addr1")
+	reg.Add("payments", "3.2", "addr2")
+	reg.Add("payments", "3.3", "addr3")
+	reg.Add("payments", "3.4", "addr4")
+
+	pick := func() (map[string]string, map[string]int) {
+		picked, counts := map[string]string{}, map[string]int{}
+		for i := 0; i < 4000; i++ {
+			caller := strconv.Itoa(i)
+			version, err := reg.PickVersion("payments", WithCallerKey(caller))
+			if err != nil {
+				t.Fatalf("Error picking version: %s", err)
+			}
+			picked[caller] = version
+			counts[version]++
+		}
+		return picked, counts
+	}
+
+	reg.setSplit("payments", map[string]int{"3.1": 25, "3.2": 25, "3.3": 25, "3.4": 25})
+	before, counts := pick()
+	for _, version := range []string{"3.1", "3.2", "3.3", "3.4"} {
+		if counts[version] < 800 || counts[version] > 1200 {
+			t.Fatalf("Unexpected distribution: %v", counts)
+		}
+	}
+
+	// Raising a version in the middle of the sorted list only moves callers to it.
+	reg.setSplit("payments", map[string]int{"3.1": 25, "3.2": 75, "3.3": 25, "3.4": 25})
+	after, counts := pick()
+	for caller, version := range after {
+		if version != before[caller] && version != "3.2" {
+			t.Fatalf("Caller %s moved from %s to %s", caller, before[caller], version)
+		}
+	}
+	if counts["3.2"] < 1800 || counts["3.2"] > 2200 {
+		t.Fatalf("Unexpected distribution: %v", counts)
+	}
+
+	// Removing a version only moves its own callers.
+	before = after
+	reg.setSplit("payments", map[string]int{"3.1": 25, "3.2": 75, "3.4": 25})
+	after, _ = pick()
+	for caller, version := range after {
+		if version != before[caller] && before[caller] != "3.3" {
+			t.Fatalf("Caller %s moved from %s to %s", caller, before[caller], version)
+		}
+	}
+}
+
+// assertEventualSplit waits for the registry to know the given split.
+func assertEventualSplit(t *testing.T, reg *ZKRegistry, name string, expect map[string]int) {
+	file, line := getCaller(t, 1)
+	var got map[string]int
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if got = reg.Split(name); reflect.DeepEqual(expect, got) {
+			return
+		}
+	}
+	t.Fatalf("[%s:%d] Unexpected split.\nExpect:\t%v\nGot:\t%v", file, line, expect, got)
+}
+
+func TestSplit(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	for version, endpoint := range map[string]string{"3.1": "addr1", "3.2": "addr2"} {
+		if _, err := conn.Register("payments", version, endpoint); err != nil {
+			t.Fatalf("Error registering endpoint: %s", err)
+		}
+	}
+	assertEventualLookup(t, conn.ZKRegistry, "payments", "3.2", []string{"addr2"}, nil)
+	if err := conn.SetAlias("payments", "stable", "3.1"); err != nil {
+		t.Fatalf("Error setting alias: %s", err)
+	}
+
+	other, err := New(conn.conn, path.Join(conn.prefix, "discovery"), discardLogger)
+	if err != nil {
+		t.Fatalf("Error creating the registry: %s", err)
+	}
+	defer func() { _ = other.Close() }() // Best effort.
+
+	if err := conn.SetSplit("payments", map[string]int{"3.1": 95, "3.2": 5}); err != nil {
+		t.Fatalf("Error setting split: %s", err)
+	}
+	assertEventualSplit(t, other, "payments", map[string]int{"3.1": 95, "3.2": 5})
+
+	// Live update.
+	if err := conn.SetSplit("payments", map[string]int{"3.2": 1}); err != nil {
+		t.Fatalf("Error setting split: %s", err)
+	}
+	assertEventualSplit(t, other, "payments", map[string]int{"3.2": 1})
+	if endpoint, version, err := other.NextAcrossVersions("payments"); err != nil || endpoint != "addr2" || version != "3.2" {
+		t.Fatalf("Unexpected pick: %s (%s, %v)", endpoint, version, err)
+	}
+	// The aliases are untouched.
+	assertEventualAliases(t, other, "payments", map[string]string{"stable": "3.1"})
+
+	// Invalid splits are rejected without any change.
+	for _, split := range []map[string]int{
+		{"3.1": 1, "4.0": 1},
+		{"3.1": -1, "3.2": 2},
+		{"3.1": 0},
+		{"a/b": 1},
+	} {
+		if err := conn.SetSplit("payments", split); err == nil {
+			t.Errorf("%v should fail", split)
+		}
+	}
+	assertEventualSplit(t, conn.ZKRegistry, "payments", map[string]int{"3.2": 1})
+
+	// Removal.
+	if err := conn.SetSplit("payments", nil); err != nil {
+		t.Fatalf("Error removing split: %s", err)
+	}
+	assertEventualSplit(t, other, "payments", map[string]int{})
+	if _, err := other.PickVersion("payments"); err != ErrNoSplit {
+		t.Fatalf("Unexpected error.\nExpect:\t%v\nGot:\t%v", ErrNoSplit, err)
+	}
+}
+
+// Make sure the reconciliation repairs the splits.
+func TestReconcileSplit(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	assertCreateTree(t, conn, "/test/discovery/name/v1/addr")
+	root := path.Join(conn.prefix, "/test/discovery")
+	if _, err := conn.conn.Set(path.Join(root, "name"), []byte(`{"split": {"v1": 1}}`), -1); err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := New(conn.conn, root, discardLogger, WithTickInterval(0))
+	if err != nil {
+		t.Fatalf("Error creating new registry: %s", err)
+	}
+	defer func() { _ = reg.Close() }() // Best effort.
+	assertEventualSplit(t, reg, "name", map[string]int{"v1": 1})
+
+	// Simulate missed events.
+	reg.setSplit("name", map[string]int{"v0": 1})
+	reg.setSplit("gone", map[string]int{"v1": 1})
+
+	_ = reg.reconcile()
+	if expect, got := map[string]int{"v1": 1}, reg.Split("name"); !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Unexpected split.\nExpect:\t%v\nGot:\t%v", expect, got)
+	}
+	if got := reg.Split("gone"); len(got) != 0 {
+		t.Fatalf("Stale split should be removed: %v", got)
+	}
+	if expect, got := (Stats{Reconciliations: 1, ReconcileRemoved: 1, ReconcileUpdated: 1}), reg.Stats(); expect != got {
+		t.Fatalf("Unexpected stats.\nExpect:\t%+v\nGot:\t%+v", expect, got)
+	}
+}
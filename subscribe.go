@@ -0,0 +1,227 @@
+package zkregistry
+
+import (
+	"sync"
+)
+
+// ServiceEvent describes a change in the endpoints of a service name/version.
+type ServiceEvent struct {
+	Name      string   `json:"name"`
+	Version   string   `json:"version"`
+	Endpoints []string `json:"endpoints"` // Full new endpoint list.
+	Added     []string `json:"added"`     // Endpoints added since the previous event.
+	Removed   []string `json:"removed"`   // Endpoints removed since the previous event.
+}
+
+// serviceKey identifies a service name/version.
+type serviceKey struct {
+	name, version string
+}
+
+// Subscription delivers the changes of the subscribed service(s) on `C`.
+// The delivery never blocks the registry: when the subscriber is slow,
+// the changes are coalesced and only the latest state is delivered.
+// NOTE: the endpoint lists reflect the zookeeper state, ejection is not applied.
+type Subscription struct {
+	C <-chan ServiceEvent // Exposed read channel, closed on Close.
+
+	reg     *ZKRegistry
+	name    string // Empty name for wildcard.
+	version string // Empty version for all the versions of the service.
+
+	lock      sync.Mutex
+	pending   map[serviceKey]struct{} // Services changed since last delivery.
+	delivered map[serviceKey][]string // Last delivered endpoints, used for the deltas.
+
+	ch       chan ServiceEvent // Internal channel for writes/close.
+	notify   chan struct{}     // Wakes up the delivery goroutine.
+	once     sync.Once
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Subscribe creates a subscription for the changes of the given service name/version.
+// An empty version subscribes to all the versions of the service, not including the aliases.
+// Subscribing to an alias delivers the endpoints of its current target, see SetAliases.
+// The current state is delivered first.
+func (reg *ZKRegistry) Subscribe(name, version string) *Subscription {
+	sub := &Subscription{
+		reg:       reg,
+		name:      name,
+		version:   version,
+		pending:   map[serviceKey]struct{}{},
+		delivered: map[serviceKey][]string{},
+		notify:    make(chan struct{}, 1),
+		stopChan:  make(chan struct{}),
+	}
+	ch := make(chan ServiceEvent)
+	sub.C, sub.ch = ch, ch
+
+	reg.subLock.Lock()
+	reg.subscriptions[sub] = struct{}{}
+	reg.subLock.Unlock()
+
+	// Queue the current state.
+	current := reg.catalog()
+	for name, versions := range current.services {
+		for version := range versions {
+			sub.publish(serviceKey{name: name, version: version})
+		}
+	}
+	if _, ok := current.aliases[name][version]; ok {
+		sub.publishAlias(serviceKey{name: name, version: version})
+	}
+
+	sub.wg.Add(1)
+	go func() {
+		defer sub.wg.Done()
+		defer close(sub.ch)
+		sub.deliver()
+	}()
+
+	return sub
+}
+
+// SubscribeAll creates a subscription for the changes of all the services.
+func (reg *ZKRegistry) SubscribeAll() *Subscription {
+	return reg.Subscribe("", "")
+}
+
+// Close terminates the subscription and closes `C`.
+func (sub *Subscription) Close() {
+	sub.once.Do(func() {
+		sub.reg.subLock.Lock()
+		delete(sub.reg.subscriptions, sub)
+		sub.reg.subLock.Unlock()
+
+		close(sub.stopChan)
+		sub.wg.Wait()
+	})
+}
+
+// match checks if the given service is part of the subscription.
+func (sub *Subscription) match(key serviceKey) bool {
+	return sub.name == "" || (sub.name == key.name && (sub.version == "" || sub.version == key.version))
+}
+
+// publish marks the given service as changed and wakes up the delivery goroutine.
+// Never blocks.
+func (sub *Subscription) publish(key serviceKey) {
+	if !sub.match(key) {
+		return
+	}
+	sub.lock.Lock()
+	sub.pending[key] = struct{}{}
+	sub.lock.Unlock()
+
+	select {
+	case sub.notify <- struct{}{}:
+	default: // Already notified.
+	}
+}
+
+// publishAlias marks the given service alias as changed, see publish.
+// Only the subscriptions naming the alias get the changes, not the wildcard ones.
+func (sub *Subscription) publishAlias(key serviceKey) {
+	if sub.name == key.name && sub.version == key.version {
+		sub.publish(key)
+	}
+}
+
+// deliver sends the latest state of the changed services to the subscriber.
+func (sub *Subscription) deliver() {
+	for {
+		select {
+		case <-sub.stopChan:
+			return
+		case <-sub.reg.stopChan:
+			return
+		case <-sub.notify:
+		}
+
+		sub.lock.Lock()
+		pending := sub.pending
+		sub.pending = map[serviceKey]struct{}{}
+		sub.lock.Unlock()
+
+		for key := range pending {
+			event, ok := sub.event(key)
+			if !ok {
+				continue
+			}
+			select {
+			case <-sub.stopChan:
+				return
+			case <-sub.reg.stopChan:
+				return
+			case sub.ch <- event:
+				if len(event.Endpoints) == 0 {
+					delete(sub.delivered, key)
+				} else {
+					sub.delivered[key] = event.Endpoints
+				}
+			}
+		}
+	}
+}
+
+// event computes the change of the given service since the last delivery.
+// Returns false if there is no change.
+func (sub *Subscription) event(key serviceKey) (ServiceEvent, bool) {
+	endpoints := []string{}
+	current := sub.reg.catalog()
+	if list, ok := current.lookup(key.name, current.resolve(key.name, key.version)); ok {
+		endpoints = list.endpoints
+	}
+
+	previous := sub.delivered[key]
+	event := ServiceEvent{
+		Name:      key.name,
+		Version:   key.version,
+		Endpoints: endpoints,
+		Added:     diffEndpoints(endpoints, previous),
+		Removed:   diffEndpoints(previous, endpoints),
+	}
+	if len(event.Added) == 0 && len(event.Removed) == 0 {
+		return event, false
+	}
+	return event, true
+}
+
+// diffEndpoints returns the endpoints from `a` not present in `b`.
+func diffEndpoints(a, b []string) []string {
+	set := make(map[string]struct{}, len(b))
+	for _, endpoint := range b {
+		set[endpoint] = struct{}{}
+	}
+	var ret []string
+	for _, endpoint := range a {
+		if _, ok := set[endpoint]; !ok {
+			ret = append(ret, endpoint)
+		}
+	}
+	return ret
+}
+
+// publish notifies the subscribers of a change on the given service name/version.
+// Never blocks.
+func (reg *ZKRegistry) publish(name, version string) {
+	key := serviceKey{name: name, version: version}
+
+	// The aliases of the version change along.
+	var aliases []serviceKey
+	for alias, target := range reg.catalog().aliases[name] {
+		if target == version {
+			aliases = append(aliases, serviceKey{name: name, version: alias})
+		}
+	}
+
+	reg.subLock.Lock()
+	for sub := range reg.subscriptions {
+		sub.publish(key)
+		for _, alias := range aliases {
+			sub.publishAlias(alias)
+		}
+	}
+	reg.subLock.Unlock()
+}
@@ -0,0 +1,169 @@
+package zkregistry
+
+import (
+	"path"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func assertServiceEvent(t *testing.T, sub *Subscription, expect ServiceEvent) {
+	file, line := getCaller(t, 1)
+	select {
+	case got, ok := <-sub.C:
+		if !ok {
+			t.Fatalf("[%s:%d] Subscription closed", file, line)
+		}
+		if !reflect.DeepEqual(expect, got) {
+			t.Fatalf("[%s:%d] Unexpected event.\nExpect:\t%+v\nGot:\t%+v", file, line, expect, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("[%s:%d] Timeout waiting for event", file, line)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	conn.Add("name", "version", "addr1")
+
+	sub := conn.Subscribe("name", "version")
+	defer sub.Close()
+
+	// The current state is delivered first.
+	assertServiceEvent(t, sub, ServiceEvent{
+		Name: "name", Version: "version",
+		Endpoints: []string{"addr1"},
+		Added:     []string{"addr1"},
+	})
+
+	conn.Add("name", "version", "addr2")
+	assertServiceEvent(t, sub, ServiceEvent{
+		Name: "name", Version: "version",
+		Endpoints: []string{"addr1", "addr2"},
+		Added:     []string{"addr2"},
+	})
+
+	// Changes on other services are not delivered.
+	conn.Add("name", "other", "addr3")
+	conn.Add("other", "version", "addr3")
+
+	conn.DeleteEndpoint("name", "version", "addr1")
+	assertServiceEvent(t, sub, ServiceEvent{
+		Name: "name", Version: "version",
+		Endpoints: []string{"addr2"},
+		Removed:   []string{"addr1"},
+	})
+
+	conn.DeleteService("name")
+	assertServiceEvent(t, sub, ServiceEvent{
+		Name: "name", Version: "version",
+		Endpoints: []string{},
+		Removed:   []string{"addr2"},
+	})
+
+	sub.Close()
+	if _, ok := <-sub.C; ok {
+		t.Fatal("Subscription channel should be closed")
+	}
+}
+
+func TestSubscribeAll(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	sub := conn.SubscribeAll()
+	defer sub.Close()
+
+	conn.Add("name1", "version", "addr1")
+	assertServiceEvent(t, sub, ServiceEvent{
+		Name: "name1", Version: "version",
+		Endpoints: []string{"addr1"},
+		Added:     []string{"addr1"},
+	})
+	conn.Add("name2", "version", "addr2")
+	assertServiceEvent(t, sub, ServiceEvent{
+		Name: "name2", Version: "version",
+		Endpoints: []string{"addr2"},
+		Added:     []string{"addr2"},
+	})
+}
+
+// Make sure a slow subscriber does not block the registry and gets the latest state.
+func TestSubscribeCoalesce(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	sub := conn.Subscribe("name", "version")
+	defer sub.Close()
+
+	if err := testTimeout(t, "registry blocked by subscriber", time.Second, func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			conn.Add("name", "version", "addr"+strconv.Itoa(i))
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first event may have been computed before all the additions,
+	// the next one should have the latest state.
+	var events []ServiceEvent
+	for len(events) == 0 || len(events[len(events)-1].Endpoints) != 100 {
+		select {
+		case event := <-sub.C:
+			events = append(events, event)
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for the latest state. Got %d events", len(events))
+		}
+	}
+	if len(events) > 2 {
+		t.Fatalf("Events should be coalesced, got %d events", len(events))
+	}
+	added := 0
+	for _, event := range events {
+		added += len(event.Added)
+	}
+	if added != 100 {
+		t.Fatalf("Unexpected number of added endpoints: %d", added)
+	}
+}
+
+// Make sure the subscription gets closed with the registry.
+func TestSubscribeRegistryClose(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	reg, err := New(conn.conn, path.Join(conn.prefix, "/test/discovery"), discardLogger)
+	if err != nil {
+		t.Fatalf("Error creating new registry: %s", err)
+	}
+	sub := reg.Subscribe("name", "version")
+	_ = reg.Close() // Best effort.
+
+	select {
+	case _, ok := <-sub.C:
+		if ok {
+			t.Fatal("Subscription channel should be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the subscription to close")
+	}
+	sub.Close()
+}
+
+func TestDiffEndpoints(t *testing.T) {
+	for _, elem := range []struct {
+		a, b, expect []string
+	}{
+		{nil, nil, nil},
+		{[]string{"a", "b"}, nil, []string{"a", "b"}},
+		{nil, []string{"a", "b"}, nil},
+		{[]string{"a", "b", "c"}, []string{"b"}, []string{"a", "c"}},
+	} {
+		if got := diffEndpoints(elem.a, elem.b); !reflect.DeepEqual(elem.expect, got) {
+			t.Errorf("Unexpected result for %v - %v.\nExpect:\t%v\nGot:\t%v", elem.a, elem.b, elem.expect, got)
+		}
+	}
+}
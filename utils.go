@@ -45,9 +45,9 @@ func parseConfigPath(zkPath string, offset uint) (serviceName, serviceVersion, e
 	}
 }
 
-// createTree recursively creates the given path.
+// createTree recursively creates the given path, the missing nodes get the given ACL.
 // TODO: remove and use zkConnector.
-func createTree(conn *zk.Conn, zkPath string) error {
+func createTree(conn *zk.Conn, zkPath string, acl []zk.ACL) error {
 	target := "/"
 	for _, elem := range strings.Split(zkPath, "/") {
 		if elem != "" {
@@ -57,7 +57,8 @@ func createTree(conn *zk.Conn, zkPath string) error {
 			} else if ok {
 				continue
 			}
-			if _, err := conn.Create(target, nil, 0, zk.WorldACL((zk.PermAll))); err != nil {
+			// Created concurrently in the meantime.
+			if _, err := conn.Create(target, nil, 0, acl); err != nil && err != zk.ErrNodeExists {
 				return fmt.Errorf("error creating %q: %s", target, err)
 			}
 		}
@@ -0,0 +1,118 @@
+package zkregistry
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// pendingCheckInterval is the interval between the lookups of the pending nodes until synced, see checkPending.
+var pendingCheckInterval = 1 * time.Second
+
+// WaitFor blocks until the service name/version has at least `minEndpoints` endpoints
+// or the context is done. Returns the endpoint list.
+// Ejected endpoints are not counted, see Lookup, the wait ends when they get readmitted.
+func (reg *ZKRegistry) WaitFor(ctx context.Context, name, version string, minEndpoints int) ([]string, error) {
+	for {
+		// Grab the change chans first so we don't miss a change made while checking.
+		current := reg.catalog()
+		ejectedChange := reg.ejectedChange.Load().(chan struct{})
+		target := current.resolve(name, version)
+		if list, ok := current.lookup(name, target); ok {
+			if targets := reg.filterEjected(name, target, list).endpoints; len(targets) >= minEndpoints {
+				return targets, nil
+			}
+		}
+
+		// Ejected endpoints come back on their own, wake up for the next readmission.
+		var timer *time.Timer
+		var readmission <-chan time.Time
+		if next := reg.nextReadmission(name, target); !next.IsZero() {
+			timer = time.NewTimer(next.Sub(time.Now()))
+			readmission = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-reg.stopChan:
+			return nil, ErrClosed
+		case <-current.changed:
+		case <-ejectedChange:
+		case <-readmission:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// WaitSynced blocks until the endpoints present in zookeeper when the registry
+// got created are applied or the context is done.
+func (reg *ZKRegistry) WaitSynced(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-reg.stopChan:
+		return ErrClosed
+	case <-reg.synced:
+		return nil
+	}
+}
+
+// initPending lists the existing instance nodes, expected to be reported by the watcher.
+func (reg *ZKRegistry) initPending() error {
+	nodes, err := walkTree(reg.conn, reg.root, reg.layout.Depth())
+	if err != nil {
+		return err
+	}
+	reg.pending = map[string]struct{}{}
+	for _, elems := range nodes {
+		if len(elems) == reg.layout.Depth() {
+			reg.pending[reg.nodePath(elems)] = struct{}{}
+		}
+	}
+	reg.checkSynced()
+	return nil
+}
+
+// resolvePending marks the given node as applied.
+// A parent node matches all the nodes below it.
+func (reg *ZKRegistry) resolvePending(zkPath string) {
+	if len(reg.pending) == 0 {
+		return
+	}
+	for node := range reg.pending {
+		if node == zkPath || strings.HasPrefix(node, zkPath+"/") {
+			delete(reg.pending, node)
+		}
+	}
+	reg.checkSynced()
+}
+
+// checkPending discards the pending nodes that don't exist anymore,
+// i.e. removed before the watch got set, the watcher won't report them.
+func (reg *ZKRegistry) checkPending() {
+	if len(reg.pending) == 0 {
+		return
+	}
+	for node := range reg.pending {
+		if ok, _, err := reg.conn.Exists(node); err == nil && !ok {
+			delete(reg.pending, node)
+		}
+	}
+	reg.checkSynced()
+}
+
+// checkSynced closes the synced chan when there is no more pending endpoint.
+func (reg *ZKRegistry) checkSynced() {
+	if len(reg.pending) != 0 {
+		return
+	}
+	select {
+	case <-reg.synced:
+	default:
+		reg.touch(&reg.lastSync)
+		close(reg.synced)
+	}
+}
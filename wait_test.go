@@ -0,0 +1,153 @@
+package zkregistry
+
+import (
+	"context"
+	"errors"
+	"path"
+	"testing"
+	"time"
+)
+
+// Make sure the pre-existing endpoints are available once synced.
+func TestWaitSynced(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	assertCreateTree(t, conn, "/test/discovery/name/version1/addr1")
+	assertCreateTree(t, conn, "/test/discovery/name/version1/addr2")
+	assertCreateTree(t, conn, "/test/discovery/name/version2/addr3")
+
+	reg, err := New(conn.conn, path.Join(conn.prefix, "/test/discovery"), discardLogger)
+	if err != nil {
+		t.Fatalf("Error creating new registry: %s", err)
+	}
+	defer func() { _ = reg.Close() }() // Best effort.
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := reg.WaitSynced(ctx); err != nil {
+		t.Fatalf("Error waiting for the registry to sync: %s", err)
+	}
+
+	// No need to wait, the registry is synced.
+	if got, err := reg.Lookup("name", "version1"); err != nil {
+		t.Fatalf("Error looking up the registry: %s", err)
+	} else if len(got) != 2 {
+		t.Fatalf("Unexpected endpoints: %v", got)
+	}
+	if got, err := reg.Lookup("name", "version2"); err != nil {
+		t.Fatalf("Error looking up the registry: %s", err)
+	} else if len(got) != 1 {
+		t.Fatalf("Unexpected endpoints: %v", got)
+	}
+}
+
+// Make sure an empty registry is synced right away.
+func TestWaitSyncedEmpty(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := conn.WaitSynced(ctx); err != nil {
+		t.Fatalf("Error waiting for the registry to sync: %s", err)
+	}
+}
+
+func TestWaitFor(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		conn.Add("name", "version", "addr1")
+		time.Sleep(10 * time.Millisecond)
+		conn.Add("name", "version", "addr2")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	got, err := conn.WaitFor(ctx, "name", "version", 2)
+	if err != nil {
+		t.Fatalf("Error waiting for endpoints: %s", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("Unexpected endpoints: %v", got)
+	}
+}
+
+func TestWaitForTimeout(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	conn.Add("name", "version", "addr1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := conn.WaitFor(ctx, "name", "version", 2); err != context.DeadlineExceeded {
+		t.Fatalf("Unexpected error.\nExpect:\t%v\nGot:\t%v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestWaitForClosed(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	reg, err := New(conn.conn, path.Join(conn.prefix, "/test/discovery"), discardLogger)
+	if err != nil {
+		t.Fatalf("Error creating new registry: %s", err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_ = reg.Close() // Best effort.
+	}()
+	if _, err := reg.WaitFor(context.Background(), "name", "version", 1); err != ErrClosed {
+		t.Fatalf("Unexpected error.\nExpect:\t%v\nGot:\t%v", ErrClosed, err)
+	}
+}
+
+// Make sure the waiters see the ejected endpoints coming back.
+func TestWaitForEjected(t *testing.T) {
+	conn := zkConnect(t)
+	defer conn.Close()
+
+	conn.SetOutlierDetection(OutlierDetection{
+		ConsecutiveFailures: 1,
+		BaseEjectionTime:    50 * time.Millisecond,
+		MaxEjectionPercent:  50,
+	})
+	conn.Add("name", "version", "addr1")
+	conn.Add("name", "version", "addr2")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Readmission after the ejection time.
+	conn.Failure("name", "version", "addr1", errors.New("failure"))
+	start := time.Now()
+	if got, err := conn.WaitFor(ctx, "name", "version", 2); err != nil {
+		t.Fatalf("Error waiting for endpoints: %s", err)
+	} else if len(got) != 2 {
+		t.Fatalf("Unexpected endpoints: %v", got)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Readmission took too long: %s", elapsed)
+	}
+
+	// Readmission on success.
+	conn.SetOutlierDetection(OutlierDetection{
+		ConsecutiveFailures: 1,
+		BaseEjectionTime:    time.Minute,
+		MaxEjectionPercent:  50,
+	})
+	conn.Failure("name", "version", "addr1", errors.New("failure"))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		conn.Success("name", "version", "addr1")
+	}()
+	if got, err := conn.WaitFor(ctx, "name", "version", 2); err != nil {
+		t.Fatalf("Error waiting for endpoints: %s", err)
+	} else if len(got) != 2 {
+		t.Fatalf("Unexpected endpoints: %v", got)
+	}
+}